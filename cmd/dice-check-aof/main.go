@@ -0,0 +1,104 @@
+// dice-check-aof validates an append only file offline and repairs it by
+// truncating it to its last valid entry
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/savannahar68/echo-server/core"
+)
+
+// excerptLen is how much of the file is shown at the first bad offset
+const excerptLen = 64
+
+func main() {
+	fix := flag.Bool("fix", false, "truncate the file to its last valid entry")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-fix] <file.aof>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	file := flag.Arg(0)
+
+	check, err := core.CheckAOF(file)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if check.Preamble > 0 {
+		fmt.Printf("Snapshot preamble: %d bytes, %d keys\n", check.Preamble, check.PreambleKeys)
+	}
+	printStats(check.Commands)
+	if check.Err == nil {
+		fmt.Printf("AOF %s is valid (%d bytes)\n", file, check.Size)
+		return
+	}
+
+	fmt.Printf("0x%x: bad file format at offset %d (line %d): %v\n", check.ErrOffset, check.ErrOffset, check.ErrLine, check.Err)
+	if excerpt, err := readExcerpt(file, check.ErrOffset); err == nil {
+		fmt.Printf("Content at offset %d: %s\n", check.ErrOffset, strconv.Quote(excerpt))
+	}
+	if !check.Fixable {
+		fmt.Println("The snapshot preamble is corrupted, the file cannot be repaired by truncation")
+		os.Exit(1)
+	}
+
+	diff := check.Size - check.ValidSize
+	fmt.Printf("AOF analyzed: size=%d, ok_up_to=%d, diff=%d\n", check.Size, check.ValidSize, diff)
+	if !*fix {
+		fmt.Println("Run with -fix to truncate the file to its last valid entry")
+		os.Exit(1)
+	}
+	if err := os.Truncate(file, check.ValidSize); err != nil {
+		fmt.Println("Failed to truncate AOF:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Successfully truncated AOF %s to %d bytes, %d bytes removed\n", file, check.ValidSize, diff)
+}
+
+// printStats prints the number of entries of every command, most used first
+func printStats(commands map[string]int) {
+	names := make([]string, 0, len(commands))
+	total := 0
+	for name, count := range commands {
+		names = append(names, name)
+		total += count
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if commands[names[i]] != commands[names[j]] {
+			return commands[names[i]] > commands[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	fmt.Printf("Commands: %d\n", total)
+	for _, name := range names {
+		fmt.Printf("  %-16s %d\n", name, commands[name])
+	}
+}
+
+// readExcerpt returns the bytes of file starting at offset
+func readExcerpt(file string, offset int64) (string, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	buf := make([]byte, excerptLen)
+	n, err := fp.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
@@ -0,0 +1,47 @@
+// dice-check-rdb validates a snapshot file offline
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/savannahar68/echo-server/core"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s <file.rdb>\n", os.Args[0])
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	file := flag.Arg(0)
+
+	check, err := core.CheckRDB(file)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if check.Err != nil {
+		fmt.Printf("Bad file format: %v\n", check.Err)
+		os.Exit(1)
+	}
+
+	types := make([]string, 0, len(check.Keys))
+	total := 0
+	for typ, count := range check.Keys {
+		types = append(types, typ)
+		total += count
+	}
+	sort.Strings(types)
+
+	fmt.Printf("Keys: %d, with an expiry: %d\n", total, check.Expires)
+	for _, typ := range types {
+		fmt.Printf("  %-16s %d\n", typ, check.Keys[typ])
+	}
+	fmt.Printf("Snapshot %s is valid (%d bytes)\n", file, check.Size)
+}
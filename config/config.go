@@ -3,7 +3,39 @@ package config
 var Host string = "0.0.0.0"
 var Port int = 7379
 var KeysLimit int = 100
+
+// Databases is the number of logical databases, selected with SELECT
+var Databases int = 16
 var AOFFile string = "./dice-master.aof"
 
+// AppendOnly enables logging every write command to AOFFile
+var AppendOnly bool = true
+
+// AppendFsync is the fsync policy of the AOF: always, everysec or no
+var AppendFsync string = "everysec"
+
+// AOFLoadTruncated lets the server start when the AOF ends with a partial
+// command, the partial command is truncated away
+var AOFLoadTruncated bool = true
+
+// AOFUseRDBPreamble makes the AOF rewrite write the dataset as a binary
+// snapshot followed by the commands logged after it, which is faster to
+// rewrite and to load
+var AOFUseRDBPreamble bool = true
+
+// RDBFile is the binary snapshot of the dataset
+var RDBFile string = "./dice-master.rdb"
+
+// Save lists the snapshot save points as pairs of "<seconds> <changes>",
+// the snapshot is saved in the background when at least <changes> changes
+// happened in the last <seconds> seconds. Empty disables the snapshots.
+var Save string = "3600 1 300 100 60 10000"
+
 var EvictionRatio float64 = 0.40
 var EvictionStrategy string = "allkeys-lru"
+
+// ProtoMaxBulkLen is the largest bulk string, in bytes, accepted from a client
+var ProtoMaxBulkLen int = 512 * 1024 * 1024
+
+// ClientQueryBufferLimit caps the unparsed bytes buffered for a single client
+var ClientQueryBufferLimit int = 1024 * 1024 * 1024
@@ -1,29 +1,571 @@
 package core
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"strconv"
 	"strings"
-
-	"github.com/savannahar68/echo-server/config"
+	"sync/atomic"
+	"time"
 )
 
-func DumpAllAOF() {
-	fp, err := os.OpenFile(config.AOFFile, os.O_CREATE|os.O_WRONLY, os.ModeAppend)
+// appendfsync policies
+const AOF_FSYNC_ALWAYS string = "always"
+const AOF_FSYNC_EVERYSEC string = "everysec"
+const AOF_FSYNC_NO string = "no"
+
+// aofState tracks the append only file of a store
+type aofState struct {
+	// file is the append only file the write commands are logged to,
+	// nil when the AOF is disabled
+	file *os.File
+	// buf accumulates the write commands executed since the last flush
+	buf []byte
+
+	lastFsync       time.Time
+	fsyncInProgress int32
+
+	// selectedDB is the database the commands logged last apply to, a
+	// SELECT is logged before a command for another one. -1 forces a
+	// SELECT.
+	selectedDB int
+
+	// currentSize and baseSize are the size of the AOF and its size
+	// right after the last rewrite
+	currentSize     int64
+	baseSize        int64
+	lastWriteStatus string
+
+	rewrite aofRewriteState
+	// rewriteScheduled is set when BGREWRITEAOF is called during a
+	// background save, the rewrite starts once the save completes
+	rewriteScheduled bool
+}
+
+// openAOF opens the append only file for appending
+func (s *Store) openAOF() error {
+	fp, err := os.OpenFile(s.config.AOFFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	s.aof.file = fp
+	s.aof.selectedDB = -1
+	s.aof.currentSize = fi.Size()
+	if s.aof.baseSize == 0 {
+		s.aof.baseSize = fi.Size()
+	}
+	return nil
+}
+
+// feedAppendOnlyFile adds the command line to the AOF buffer, preceded by
+// a SELECT when the client works on another database than the previous
+// command logged. Commands run by EXEC are wrapped in MULTI/EXEC so that
+// the transaction is replayed atomically.
+func (s *Store) feedAppendOnlyFile(argv []string, c *Client) {
+	if (s.aof.file == nil && !s.aof.rewrite.inProgress) || s.loading {
+		return
+	}
+
+	if c.isTxn && !c.isTxnPropagated {
+		s.appendToAOFBuf(Encode([]string{"MULTI"}, false))
+		c.isTxnPropagated = true
+	}
+	s.feedSelect(c.db.ID)
+	s.appendToAOFBuf(Encode(argv, false))
+}
+
+// feedEviction logs the DEL of a key evicted from db, the eviction
+// depends on the access times and is not replayed by the command that
+// caused it
+func (s *Store) feedEviction(db *DB, key string) {
+	if (s.aof.file == nil && !s.aof.rewrite.inProgress) || s.loading {
+		return
+	}
+	s.feedSelect(db.ID)
+	s.appendToAOFBuf(Encode([]string{"DEL", key}, false))
+}
+
+// feedSelect logs a SELECT when id is not the database of the previous
+// command logged
+func (s *Store) feedSelect(id int) {
+	if id != s.aof.selectedDB {
+		s.appendToAOFBuf(Encode([]string{"SELECT", strconv.Itoa(id)}, false))
+		s.aof.selectedDB = id
+	}
+}
+
+// appendToAOFBuf adds encoded commands to the AOF buffer and, while a
+// rewrite is in progress, to the rewrite buffer
+func (s *Store) appendToAOFBuf(b []byte) {
+	if s.aof.file != nil {
+		s.aof.buf = append(s.aof.buf, b...)
+	}
+	if s.aof.rewrite.inProgress {
+		s.aof.rewrite.buf = append(s.aof.rewrite.buf, b...)
+	}
+}
+
+// flushAppendOnlyFile writes the AOF buffer to the file and fsyncs it
+// according to the appendfsync policy. It is called before replying to
+// the clients, so that with "always" a reply is never sent for a write
+// that is not on disk yet.
+func (s *Store) flushAppendOnlyFile() {
+	if s.aof.file == nil {
+		return
+	}
+
+	if len(s.aof.buf) > 0 {
+		n, err := s.aof.file.Write(s.aof.buf)
+		// keep what could not be written for the next flush
+		s.aof.buf = s.aof.buf[n:]
+		s.aof.currentSize += int64(n)
+		if err != nil {
+			log.Println("error writing the AOF file", err)
+			s.aof.lastWriteStatus = "err"
+			return
+		}
+		s.aof.lastWriteStatus = "ok"
+		if cap(s.aof.buf) > 4*1024*1024 {
+			s.aof.buf = nil
+		}
+	}
+
+	switch s.config.AppendFsync {
+	case AOF_FSYNC_ALWAYS:
+		if err := s.aof.file.Sync(); err != nil {
+			log.Println("error fsyncing the AOF file", err)
+		}
+		s.aof.lastFsync = time.Now()
+	case AOF_FSYNC_EVERYSEC:
+		if time.Since(s.aof.lastFsync) < time.Second {
+			return
+		}
+		// fsync off the event loop, skipping this second if the
+		// previous fsync did not complete yet
+		if !atomic.CompareAndSwapInt32(&s.aof.fsyncInProgress, 0, 1) {
+			return
+		}
+		s.aof.lastFsync = time.Now()
+		go func(fp *os.File) {
+			if err := fp.Sync(); err != nil {
+				log.Println("error fsyncing the AOF file", err)
+			}
+			atomic.StoreInt32(&s.aof.fsyncInProgress, 0)
+		}(s.aof.file)
+	}
+}
+
+// closeAOF flushes and fsyncs the pending writes and closes the file
+func (s *Store) closeAOF() {
+	if s.aof.file == nil {
+		return
+	}
+	s.flushAppendOnlyFile()
+	if err := s.aof.file.Sync(); err != nil {
+		log.Println("error fsyncing the AOF file", err)
+	}
+	s.aof.file.Close()
+	s.aof.file = nil
+}
+
+// aofRewriteState tracks the background rewrite of the AOF. The rewrite
+// works on a point in time copy of the keyspace while the event loop keeps
+// serving clients, the writes executed in the meantime are accumulated in
+// buf and appended to the new file before it replaces the old one.
+type aofRewriteState struct {
+	inProgress bool
+	start      time.Time
+	tmpFile    string
+	buf        []byte
+	done       chan error
+
+	lastDuration time.Duration
+	lastStatus   string
+}
+
+// rewriteAppendOnlyFileBackground starts rewriting the AOF off the event loop
+func (s *Store) rewriteAppendOnlyFileBackground() error {
+	if s.aof.rewrite.inProgress {
+		return errors.New("ERR Background append only file rewriting already in progress")
+	}
+	if s.rdb.inProgress {
+		return errors.New("ERR Background save in progress")
+	}
+
+	fp, err := createTempFile(s.config.AOFFile, "temp-rewriteaof-bg-*.aof")
 	if err != nil {
-		fmt.Println("error", err)
+		return err
+	}
+	entries := s.snapshotKeyspace()
+
+	s.aof.rewrite.inProgress = true
+	s.aof.rewrite.start = time.Now()
+	s.aof.rewrite.tmpFile = fp.Name()
+	s.aof.rewrite.buf = nil
+	s.aof.rewrite.done = make(chan error, 1)
+	// the rewritten file ends on the database of its last key, the
+	// commands buffered for it must select theirs
+	s.aof.selectedDB = -1
+
+	log.Println("background append only file rewriting started")
+	go func(done chan<- error) {
+		done <- writeAOFSnapshot(fp, entries, s.config.AOFUseRDBPreamble)
+	}(s.aof.rewrite.done)
+	return nil
+}
+
+// writeAOFSnapshot writes the commands rebuilding entries to fp and
+// closes it. With aof-use-rdb-preamble the entries are written as a
+// binary snapshot instead, faster to write and to load, and the writes
+// that follow are appended to it as commands.
+func writeAOFSnapshot(fp *os.File, entries []snapshotEntry, preamble bool) error {
+	defer fp.Close()
+
+	w := bufio.NewWriter(fp)
+	if preamble {
+		if err := writeRDB(w, entries); err != nil {
+			return err
+		}
+	} else {
+		db := -1
+		for _, e := range entries {
+			if e.db != db {
+				db = e.db
+				if _, err := w.Write(Encode([]string{"SELECT", strconv.Itoa(db)}, false)); err != nil {
+					return err
+				}
+			}
+			if err := rewriteObject(w, e); err != nil {
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return fp.Sync()
+}
+
+// checkAOFRewriteDone completes the background rewrite once the snapshot
+// has been written: the writes accumulated in the meantime are appended
+// and the new file atomically replaces the old one
+func (s *Store) checkAOFRewriteDone(wait bool) {
+	if !s.aof.rewrite.inProgress {
 		return
 	}
 
-	fmt.Println("rewriting AOF file at ", config.AOFFile)
-	for k, obj := range store {
-		dumpKey(fp, k, obj)
+	var err error
+	if wait {
+		err = <-s.aof.rewrite.done
+	} else {
+		select {
+		case err = <-s.aof.rewrite.done:
+		default:
+			return
+		}
+	}
+
+	if err == nil {
+		err = s.finishAOFRewrite()
+	}
+	if err != nil {
+		log.Println("background append only file rewriting failed", err)
+		os.Remove(s.aof.rewrite.tmpFile)
+		s.aof.rewrite.lastStatus = "err"
+	} else {
+		log.Println("background append only file rewriting terminated with success")
+		s.aof.rewrite.lastStatus = "ok"
 	}
-	fmt.Println("rewriting AOF file done at file ", config.AOFFile)
+
+	s.aof.rewrite.lastDuration = time.Since(s.aof.rewrite.start)
+	s.aof.rewrite.inProgress = false
+	s.aof.rewrite.buf = nil
 }
 
-func dumpKey(fp *os.File, key string, obj *Obj) {
-	cmd := fmt.Sprintf("SET %s %s", key, obj.Value)
-	tokens := strings.Split(cmd, " ")
-	fp.Write(Encode(tokens, false))
+func (s *Store) finishAOFRewrite() error {
+	fp, err := os.OpenFile(s.aof.rewrite.tmpFile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(s.aof.rewrite.buf); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+
+	// the old file is not needed anymore, what is still buffered for it
+	// is part of the rewrite buffer as well
+	s.aof.buf = s.aof.buf[:0]
+	if err := os.Rename(s.aof.rewrite.tmpFile, s.config.AOFFile); err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(s.config.AOFFile)
+	if err != nil {
+		return err
+	}
+	s.aof.currentSize, s.aof.baseSize = fi.Size(), fi.Size()
+
+	if s.aof.file == nil {
+		return nil
+	}
+	s.aof.file.Close()
+	s.aof.file = nil
+	if err := s.openAOF(); err != nil {
+		return errors.New("could not reopen the AOF file: " + err.Error())
+	}
+	return nil
+}
+
+// abortAOFRewrite waits for the background rewrite to stop writing and
+// throws its result away
+func (s *Store) abortAOFRewrite() {
+	if !s.aof.rewrite.inProgress {
+		return
+	}
+	<-s.aof.rewrite.done
+	os.Remove(s.aof.rewrite.tmpFile)
+	s.aof.rewrite.inProgress = false
+	s.aof.rewrite.buf = nil
+}
+
+// rewriteObject writes the commands rebuilding the key of e: the command
+// creating a value of its type followed, when it has a TTL, by a PEXPIREAT
+// to the absolute expiry so that the TTL does not restart on reload
+func rewriteObject(w io.Writer, e snapshotEntry) error {
+	var argv []string
+	switch GetType(e.obj.TypeEncoding) {
+	case OBJ_TYPE_STRING:
+		argv = []string{"SET", e.key, getString(&e.obj)}
+	default:
+		return fmt.Errorf("unknown type %d of key %q", GetType(e.obj.TypeEncoding), e.key)
+	}
+
+	if _, err := w.Write(Encode(argv, false)); err != nil {
+		return err
+	}
+	if e.expireAt == 0 {
+		return nil
+	}
+	_, err := w.Write(Encode([]string{"PEXPIREAT", e.key, strconv.FormatUint(e.expireAt, 10)}, false))
+	return err
+}
+
+// aofReader reads the commands of an append only file one at a time,
+// reusing the incremental RESP decoder of the clients
+type aofReader struct {
+	r   io.Reader
+	buf []byte
+	pos int
+	eof bool
+	// offset is the position in the file of the end of the last entry
+	// read, line the line number at that position counted from the
+	// start of the commands
+	offset int64
+	line   int
+	dec    decoder
+}
+
+func newAOFReader(r io.Reader, dec decoder) *aofReader {
+	return &aofReader{r: r, line: 1, dec: dec}
+}
+
+// next returns the next command of the file, io.EOF once all of them have
+// been read and ErrIncomplete when the file ends with a partial entry
+func (ar *aofReader) next() ([]string, error) {
+	for {
+		// blank lines between entries are tolerated, older versions
+		// of the dump left some behind
+		for ar.pos < len(ar.buf) && (ar.buf[ar.pos] == '\r' || ar.buf[ar.pos] == '\n') {
+			ar.advance(1)
+		}
+
+		if ar.pos < len(ar.buf) {
+			value, delta, err := ar.dec.decodeOne(ar.buf[ar.pos:], 0)
+			if err == nil {
+				argv, ok := toArgv(value)
+				if !ok || len(argv) == 0 {
+					return nil, errors.New("expected an array of bulk strings")
+				}
+				ar.advance(delta)
+				return argv, nil
+			}
+			if err != ErrIncomplete {
+				return nil, err
+			}
+		}
+
+		if ar.eof {
+			if ar.pos < len(ar.buf) {
+				return nil, ErrIncomplete
+			}
+			return nil, io.EOF
+		}
+		if err := ar.fill(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (ar *aofReader) advance(delta int) {
+	ar.line += bytes.Count(ar.buf[ar.pos:ar.pos+delta], []byte{'\n'})
+	ar.offset += int64(delta)
+	ar.pos += delta
+}
+
+// fill reads the next chunk of the file after the unconsumed bytes
+func (ar *aofReader) fill() error {
+	n := copy(ar.buf, ar.buf[ar.pos:])
+	ar.buf = ar.buf[:n]
+	ar.pos = 0
+
+	if cap(ar.buf)-len(ar.buf) < ioBufLen {
+		buf := make([]byte, len(ar.buf), 2*cap(ar.buf)+4*ioBufLen)
+		copy(buf, ar.buf)
+		ar.buf = buf
+	}
+
+	n, err := ar.r.Read(ar.buf[len(ar.buf):cap(ar.buf)])
+	ar.buf = ar.buf[:len(ar.buf)+n]
+	if err == io.EOF {
+		ar.eof = true
+		return nil
+	}
+	return err
+}
+
+// toArgv converts a decoded RESP array of bulk strings into a command line
+func toArgv(value interface{}) ([]string, bool) {
+	elems, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	argv := make([]string, len(elems))
+	for i := range elems {
+		if argv[i], ok = elems[i].(string); !ok {
+			return nil, false
+		}
+	}
+	return argv, true
+}
+
+// LoadAOF restores the dataset by replaying the append only file through
+// the command dispatcher. With aof-load-truncated a partial entry at the
+// end of the file, left by a crash in the middle of a write, is truncated
+// away instead of failing the load.
+func (s *Store) LoadAOF() error {
+	fp, err := os.Open(s.config.AOFFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+
+	s.loading = true
+	defer func() { s.loading = false }()
+
+	log.Println("loading AOF file", s.config.AOFFile)
+	start := time.Now()
+	lastProgress := start
+
+	// the file may start with the snapshot written by a rewrite with
+	// aof-use-rdb-preamble, the commands logged after it follow
+	r := bufio.NewReaderSize(fp, ioBufLen)
+	var preamble int64
+	if magic, _ := r.Peek(len(RDB_MAGIC)); string(magic) == RDB_MAGIC {
+		keys, n, err := s.loadSnapshot(r)
+		if err != nil {
+			return fmt.Errorf("bad snapshot preamble in the append only file: %v", err)
+		}
+		log.Printf("reading the snapshot preamble of the AOF file: %d keys", keys)
+		preamble = n
+	}
+
+	c := s.NewClient(-1)
+	ar := newAOFReader(r, s.decoder())
+	ar.offset = preamble
+	commands := 0
+	// the offset right before the MULTI of the transaction being read,
+	// a transaction cut by the end of the file is dropped as a whole
+	var multiOffset int64
+	var multiLine int
+
+	for {
+		offset, line := ar.offset, ar.line
+		argv, err := ar.next()
+		if err == io.EOF {
+			break
+		}
+		if err == ErrIncomplete {
+			if c.isTxn {
+				return s.truncateAOF(multiOffset, multiLine, fi.Size())
+			}
+			return s.truncateAOF(ar.offset, ar.line, fi.Size())
+		}
+		if err != nil {
+			return fmt.Errorf("bad file format reading the append only file at offset %d (line %d): %v", ar.offset, ar.line, err)
+		}
+
+		// the file was written by a server knowing every command it
+		// holds, an entry that can not be run means it is not usable
+		cmd := &RedisCmd{Cmd: argv[0], Args: argv[1:]}
+		if _, err := lookupAndCheck(cmd); err != nil {
+			return fmt.Errorf("%s reading the append only file at offset %d (line %d)", strings.TrimSpace(strings.TrimPrefix(err.Error(), "ERR ")), offset, line)
+		}
+		if !c.isTxn {
+			multiOffset, multiLine = offset, line
+		}
+		processCommand(cmd, c)
+		commands++
+
+		if time.Since(lastProgress) > time.Second {
+			log.Printf("loading AOF file: %d%% (%d commands)", 100*ar.offset/fi.Size(), commands)
+			lastProgress = time.Now()
+		}
+	}
+
+	if c.isTxn {
+		return s.truncateAOF(multiOffset, multiLine, fi.Size())
+	}
+
+	log.Printf("DB loaded from append only file: %.3f seconds, %d commands", time.Since(start).Seconds(), commands)
+	return nil
+}
+
+// truncateAOF handles an AOF ending with a partial entry starting at offset
+func (s *Store) truncateAOF(offset int64, line int, size int64) error {
+	if !s.config.AOFLoadTruncated {
+		return fmt.Errorf("unexpected end of file reading the append only file at offset %d (line %d), "+
+			"start the server with -aof-load-truncated to recover", offset, line)
+	}
+
+	log.Printf("!!! Warning: short read while loading the AOF file %s at offset %d (line %d), "+
+		"truncating the last %d bytes", s.config.AOFFile, offset, line, size-offset)
+	if err := os.Truncate(s.config.AOFFile, offset); err != nil {
+		return fmt.Errorf("could not truncate the append only file: %v", err)
+	}
+	return nil
 }
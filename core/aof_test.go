@@ -0,0 +1,396 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAOFLogsWriteCommands(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	s.config.AppendFsync = AOF_FSYNC_ALWAYS
+	if err := s.openAOF(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.closeAOF()
+
+	c := s.NewClient(-1)
+	for _, line := range []string{
+		"SET aof-k 1",
+		"GET aof-k",
+		"DEL aof-missing",
+		"MULTI",
+		"INCR aof-k",
+		"EXPIRE aof-k 100",
+		"EXEC",
+		"DEL aof-k",
+	} {
+		tokens := strings.Fields(line)
+		processCommand(&RedisCmd{Cmd: tokens[0], Args: tokens[1:]}, c)
+	}
+	s.flushAppendOnlyFile()
+
+	data, err := os.ReadFile(s.config.AOFFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, value := range values {
+		tokens := make([]string, 0)
+		for _, token := range value.([]interface{}) {
+			tokens = append(tokens, token.(string))
+		}
+		lines = append(lines, strings.Join(tokens, " "))
+	}
+	// relative TTLs are logged as absolute ones
+	for i, line := range lines {
+		if tokens := strings.Fields(line); tokens[0] == "PEXPIREAT" {
+			exp, _ := strconv.ParseInt(tokens[2], 10, 64)
+			if d := exp - time.Now().UnixMilli(); d <= 90*1000 || d > 100*1000 {
+				t.Fatalf("unexpected expiry %d for a TTL of 100 seconds", exp)
+			}
+			lines[i] = "PEXPIREAT " + tokens[1] + " <exp>"
+		}
+	}
+	expected := "SELECT 0|SET aof-k 1|MULTI|INCR aof-k|PEXPIREAT aof-k <exp>|EXEC|DEL aof-k"
+	if actual := strings.Join(lines, "|"); actual != expected {
+		t.Fatalf("actual %q and expected %q mismatch", actual, expected)
+	}
+}
+
+func TestLoadAOF(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+
+	valid := string(Encode([]string{"SET", "load-k", "hello world"}, false)) + "\r\n" +
+		string(Encode([]string{"MULTI"}, false)) +
+		string(Encode([]string{"SET", "load-txn", "1"}, false)) +
+		string(Encode([]string{"INCR", "load-txn"}, false)) +
+		string(Encode([]string{"EXEC"}, false))
+	// a transaction cut in the middle is dropped as a whole
+	truncated := valid + string(Encode([]string{"MULTI"}, false)) + string(Encode([]string{"SET", "load-cut", "1"}, false)) + "*2\r\n$3\r\nDEL"
+
+	os.WriteFile(s.config.AOFFile, []byte(truncated), 0644)
+	s.config.AOFLoadTruncated = false
+	if err := s.LoadAOF(); err == nil || !strings.Contains(err.Error(), "offset") {
+		t.Fatalf("expected a load error reporting the offset, got %v", err)
+	}
+
+	s.config.AOFLoadTruncated = true
+	if err := s.LoadAOF(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(s.config.AOFFile); string(data) != valid {
+		t.Fatalf("the AOF was not truncated to the last valid entry: %q", data)
+	}
+
+	if obj := s.dbs[0].Get("load-k"); obj == nil || obj.Value != "hello world" {
+		t.Fatalf("load-k was not restored: %+v", obj)
+	}
+	if obj := s.dbs[0].Get("load-txn"); obj == nil || obj.Value != int64(2) {
+		t.Fatalf("load-txn was not restored: %+v", obj)
+	}
+	if obj := s.dbs[0].Get("load-cut"); obj != nil {
+		t.Fatalf("the partial transaction was replayed")
+	}
+
+	os.WriteFile(s.config.AOFFile, []byte("*1\r\n:1\r\n"), 0644)
+	if err := s.LoadAOF(); err == nil {
+		t.Fatalf("expected a bad format error")
+	}
+}
+
+func TestLoadAOFRefusesInvalidCommands(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+
+	valid := string(Encode([]string{"SET", "k", "v"}, false))
+	for _, tc := range []struct {
+		entry    []string
+		expected string
+	}{
+		{[]string{"SETT", "k", "v"}, "unknown command 'SETT'"},
+		{[]string{"SET", "k"}, "wrong number of arguments for 'set' command"},
+	} {
+		os.WriteFile(s.config.AOFFile, []byte(valid+string(Encode(tc.entry, false))), 0644)
+		err := s.Startup()
+		if err == nil || !strings.Contains(err.Error(), tc.expected) ||
+			!strings.Contains(err.Error(), "at offset "+strconv.Itoa(len(valid))+" (line 8)") {
+			t.Fatalf("%v: unexpected error %v", tc.entry, err)
+		}
+	}
+}
+
+func TestBackgroundAOFRewrite(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	if err := s.openAOF(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.closeAOF()
+
+	c := s.NewClient(-1)
+	runAll := func(lines ...string) {
+		for _, line := range lines {
+			tokens := strings.Fields(line)
+			processCommand(&RedisCmd{Cmd: tokens[0], Args: tokens[1:]}, c)
+		}
+		s.flushAppendOnlyFile()
+	}
+
+	runAll("SET rw-a 1", "SET rw-b 1", "INCR rw-a", "INCR rw-a")
+	if reply := run(c, "BGREWRITEAOF"); !strings.HasPrefix(reply, "+Background") {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	if reply := run(c, "BGREWRITEAOF"); !strings.HasPrefix(reply, "-ERR") {
+		t.Fatalf("expected a rewrite in progress error got %q", reply)
+	}
+	// writes racing with the rewrite must survive it
+	runAll("SET rw-c 1", "DEL rw-b")
+	s.checkAOFRewriteDone(true)
+	runAll("INCR rw-c")
+
+	if s.aof.rewrite.lastStatus != "ok" {
+		t.Fatalf("rewrite failed")
+	}
+	for _, k := range []string{"rw-a", "rw-b", "rw-c"} {
+		s.dbs[0].Del(k)
+	}
+	s.closeAOF()
+	if err := s.LoadAOF(); err != nil {
+		t.Fatal(err)
+	}
+
+	if obj := s.dbs[0].Get("rw-a"); obj == nil || obj.Value != int64(3) {
+		t.Fatalf("rw-a was not restored: %+v", obj)
+	}
+	if obj := s.dbs[0].Get("rw-b"); obj != nil {
+		t.Fatalf("rw-b was restored after being deleted")
+	}
+	if obj := s.dbs[0].Get("rw-c"); obj == nil || obj.Value != int64(2) {
+		t.Fatalf("rw-c was not restored: %+v", obj)
+	}
+}
+
+func TestAOFRewritePreservesValuesAndTTLs(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+
+	c := s.NewClient(-1)
+	executeCommand(&RedisCmd{Cmd: "SET", Args: []string{"ttl-k", "hello world", "EX", "100"}}, c)
+	executeCommand(&RedisCmd{Cmd: "SET", Args: []string{"ttl-persistent", "a b c"}}, c)
+	exp, _ := s.dbs[0].getExpiry(s.dbs[0].Get("ttl-k"))
+
+	if err := s.rewriteAppendOnlyFileBackground(); err != nil {
+		t.Fatal(err)
+	}
+	s.checkAOFRewriteDone(true)
+	s.dbs[0].Del("ttl-k")
+	s.dbs[0].Del("ttl-persistent")
+	if err := s.LoadAOF(); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := s.dbs[0].Get("ttl-k")
+	if obj == nil || obj.Value != "hello world" {
+		t.Fatalf("ttl-k was not restored: %+v", obj)
+	}
+	if actual, _ := s.dbs[0].getExpiry(obj); actual != exp {
+		t.Fatalf("the TTL of ttl-k moved from %d to %d", exp, actual)
+	}
+	obj = s.dbs[0].Get("ttl-persistent")
+	if obj == nil || obj.Value != "a b c" {
+		t.Fatalf("ttl-persistent was not restored: %+v", obj)
+	}
+	if _, ok := s.dbs[0].getExpiry(obj); ok {
+		t.Fatalf("ttl-persistent was restored with a TTL")
+	}
+}
+
+func TestAOFRewriteWithRDBPreamble(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	s.config.AOFUseRDBPreamble = true
+	if err := s.openAOF(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.closeAOF()
+
+	c := s.NewClient(-1)
+	executeCommand(&RedisCmd{Cmd: "SET", Args: []string{"pre-ttl", "hello world", "EX", "100"}}, c)
+	executeCommand(&RedisCmd{Cmd: "SET", Args: []string{"pre-a", "1"}}, c)
+	exp, _ := s.dbs[0].getExpiry(s.dbs[0].Get("pre-ttl"))
+
+	if err := s.rewriteAppendOnlyFileBackground(); err != nil {
+		t.Fatal(err)
+	}
+	// the writes racing with the rewrite make the tail of the file
+	executeCommand(&RedisCmd{Cmd: "INCR", Args: []string{"pre-a"}}, c)
+	executeCommand(&RedisCmd{Cmd: "SET", Args: []string{"pre-b", "x"}}, c)
+	s.checkAOFRewriteDone(true)
+	executeCommand(&RedisCmd{Cmd: "INCR", Args: []string{"pre-a"}}, c)
+	s.flushAppendOnlyFile()
+	s.closeAOF()
+
+	data, err := os.ReadFile(s.config.AOFFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), RDB_MAGIC) {
+		t.Fatalf("the rewritten file does not start with a snapshot: %q", data[:16])
+	}
+	// a partial command at the end is truncated after the preamble
+	if err := os.WriteFile(s.config.AOFFile, append(data, "*2\r\n$3\r\nDEL"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"pre-ttl", "pre-a", "pre-b"} {
+		s.dbs[0].Del(k)
+	}
+	if err := s.LoadAOF(); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := s.dbs[0].Get("pre-ttl")
+	if obj == nil || obj.Value != "hello world" {
+		t.Fatalf("pre-ttl was not restored: %+v", obj)
+	}
+	if actual, _ := s.dbs[0].getExpiry(obj); actual != exp {
+		t.Fatalf("the TTL of pre-ttl moved from %d to %d", exp, actual)
+	}
+	if obj := s.dbs[0].Get("pre-a"); obj == nil || obj.Value != int64(3) {
+		t.Fatalf("pre-a was not restored: %+v", obj)
+	}
+	if obj := s.dbs[0].Get("pre-b"); obj == nil || obj.Value != "x" {
+		t.Fatalf("pre-b was not restored: %+v", obj)
+	}
+	if fi, _ := os.Stat(s.config.AOFFile); fi.Size() != int64(len(data)) {
+		t.Fatalf("the file was truncated to %d bytes instead of %d", fi.Size(), len(data))
+	}
+}
+
+func TestCheckAOF(t *testing.T) {
+	t.Parallel()
+	set := string(Encode([]string{"SET", "k", "v"}, false))
+	multi := string(Encode([]string{"MULTI"}, false))
+	exec := string(Encode([]string{"EXEC"}, false))
+
+	for _, tc := range []struct {
+		name      string
+		data      string
+		valid     bool
+		validSize int
+		errOffset int
+	}{
+		{"valid", set + multi + set + exec, true, 2*len(set) + len(multi) + len(exec), 0},
+		{"truncated", set + set[:5], false, len(set), len(set)},
+		{"open multi", set + multi + set, false, len(set), len(set)},
+		{"unexpected exec", set + exec + set, false, len(set), len(set)},
+		{"garbage", set + "$3\r\nfoo\r\n" + set, false, len(set), len(set)},
+	} {
+		file := filepath.Join(t.TempDir(), "test.aof")
+		if err := os.WriteFile(file, []byte(tc.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		check, err := CheckAOF(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (check.Err == nil) != tc.valid {
+			t.Fatalf("%s: unexpected result %v", tc.name, check.Err)
+		}
+		if check.ValidSize != int64(tc.validSize) || (!tc.valid && check.ErrOffset != int64(tc.errOffset)) {
+			t.Fatalf("%s: valid up to %d with an error at %d, expected %d and %d",
+				tc.name, check.ValidSize, check.ErrOffset, tc.validSize, tc.errOffset)
+		}
+		if !tc.valid && !check.Fixable {
+			t.Fatalf("%s: expected the file to be fixable", tc.name)
+		}
+	}
+}
+
+func TestAOFSelectsDatabases(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	if err := s.openAOF(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.closeAOF()
+
+	c := s.NewClient(-1)
+	for _, line := range []string{"SET sel-a 1", "SELECT 2", "SET sel-b 2", "MOVE sel-b 3", "SELECT 0", "INCR sel-a"} {
+		run(c, line)
+	}
+	s.flushAppendOnlyFile()
+	s.closeAOF()
+
+	check := func() {
+		for _, db := range s.dbs {
+			db.flush()
+		}
+		if err := s.LoadAOF(); err != nil {
+			t.Fatal(err)
+		}
+		if obj := s.dbs[0].Get("sel-a"); obj == nil || obj.Value != int64(2) {
+			t.Fatalf("sel-a was not restored in db 0: %+v", obj)
+		}
+		if obj := s.dbs[3].Get("sel-b"); obj == nil || obj.Value != int64(2) || len(s.dbs[2].dict) != 0 {
+			t.Fatalf("sel-b was not restored in db 3: %+v", obj)
+		}
+	}
+	check()
+	// the rewritten files must restore the same databases
+	for _, preamble := range []bool{false, true} {
+		s.config.AOFUseRDBPreamble = preamble
+		if err := s.rewriteAppendOnlyFileBackground(); err != nil {
+			t.Fatal(err)
+		}
+		s.checkAOFRewriteDone(true)
+		check()
+	}
+}
+
+func TestAOFReplaysEvictions(t *testing.T) {
+	t.Parallel()
+	for _, strategy := range []string{"simple-first", "allkeys-random", "allkeys-lru"} {
+		s := newTestStore(t)
+		s.config.KeysLimit = 10
+		s.config.EvictionStrategy = strategy
+		if err := s.openAOF(); err != nil {
+			t.Fatal(err)
+		}
+
+		c := s.NewClient(-1)
+		run(c, "SELECT 1")
+		for i := 0; i < 30; i++ {
+			run(c, "SET k"+strconv.Itoa(i)+" v")
+		}
+		s.flushAppendOnlyFile()
+		s.closeAOF()
+
+		loaded := newTestStore(t)
+		loaded.config.KeysLimit = 10
+		loaded.config.EvictionStrategy = strategy
+		loaded.config.AOFFile = s.config.AOFFile
+		if err := loaded.LoadAOF(); err != nil {
+			t.Fatal(err)
+		}
+		if len(loaded.dbs[1].dict) != len(s.dbs[1].dict) {
+			t.Fatalf("%s: %d keys were restored instead of %d", strategy, len(loaded.dbs[1].dict), len(s.dbs[1].dict))
+		}
+		for key := range s.dbs[1].dict {
+			if loaded.dbs[1].Get(key) == nil {
+				t.Fatalf("%s: %s was not restored", strategy, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/savannahar68/echo-server/config"
+)
+
+// AOFCheck is the result of the validation of an append only file
+type AOFCheck struct {
+	Size int64
+	// Preamble is the size of the snapshot the file starts with, 0 if
+	// it does not start with one, and PreambleKeys its number of keys
+	Preamble     int64
+	PreambleKeys int
+	// Commands counts the entries of the file by command name
+	Commands map[string]int
+	// Err is why the file is invalid, nil if it is valid
+	Err error
+	// ErrOffset and ErrLine locate the first invalid entry
+	ErrOffset int64
+	ErrLine   int
+	// ValidSize is the size of the longest prefix of the file that can
+	// be loaded, when Fixable the file is repaired by truncating it there
+	ValidSize int64
+	Fixable   bool
+}
+
+// CheckAOF validates every entry of the append only file: a snapshot
+// preamble if any followed by arrays of bulk strings, with MULTI and EXEC
+// balanced. The error is about the file itself, not its content.
+func CheckAOF(file string) (*AOFCheck, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	check := &AOFCheck{Size: fi.Size(), Commands: make(map[string]int)}
+	r := bufio.NewReaderSize(fp, ioBufLen)
+	if magic, _ := r.Peek(len(RDB_MAGIC)); string(magic) == RDB_MAGIC {
+		n, err := readRDB(r, config.ProtoMaxBulkLen, func(e snapshotEntry) error {
+			check.PreambleKeys++
+			return nil
+		})
+		if err != nil {
+			// the commands cannot be replayed without their snapshot,
+			// the file is not fixable
+			check.Err = fmt.Errorf("bad snapshot preamble: %v", err)
+			check.ErrOffset, check.ErrLine = n, 1
+			return check, nil
+		}
+		check.Preamble = n
+	}
+
+	ar := newAOFReader(r, decoder{maxBulkLen: config.ProtoMaxBulkLen})
+	ar.offset = check.Preamble
+	check.ValidSize = ar.offset
+	inMulti := false
+	// the position of the MULTI of the transaction being read, a
+	// transaction is only valid once its EXEC has been read
+	var multiOffset int64
+	var multiLine int
+
+	for {
+		offset, line := ar.offset, ar.line
+		argv, err := ar.next()
+		if err == io.EOF {
+			break
+		}
+		if err == ErrIncomplete {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			check.Err, check.ErrOffset, check.ErrLine = err, ar.offset, ar.line
+			check.Fixable = true
+			return check, nil
+		}
+
+		name := strings.ToLower(argv[0])
+		switch {
+		case name == "multi" && inMulti:
+			check.Err, check.ErrOffset, check.ErrLine = errors.New("unexpected MULTI"), offset, line
+			check.Fixable = true
+			return check, nil
+		case name == "multi":
+			inMulti = true
+			multiOffset, multiLine = offset, line
+		case name == "exec" && !inMulti:
+			check.Err, check.ErrOffset, check.ErrLine = errors.New("unexpected EXEC"), offset, line
+			check.Fixable = true
+			return check, nil
+		case name == "exec":
+			inMulti = false
+		}
+		check.Commands[name]++
+		if !inMulti {
+			check.ValidSize = ar.offset
+		}
+	}
+
+	if inMulti {
+		check.Err = errors.New("reached the end of the file before the EXEC of a MULTI")
+		check.ErrOffset, check.ErrLine = multiOffset, multiLine
+		check.Fixable = true
+	}
+	return check, nil
+}
+
+// RDBCheck is the result of the validation of a snapshot file
+type RDBCheck struct {
+	Size int64
+	// Keys counts the keys by type name, Expires the keys with a TTL
+	Keys    map[string]int
+	Expires int
+	// Err is why the file is invalid, nil if it is valid
+	Err error
+	// ErrOffset is the position of the first invalid byte
+	ErrOffset int64
+}
+
+// CheckRDB validates the snapshot file down to its checksum
+func CheckRDB(file string) (*RDBCheck, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	check := &RDBCheck{Size: fi.Size(), Keys: make(map[string]int)}
+	r := bufio.NewReader(fp)
+	n, err := readRDB(r, config.ProtoMaxBulkLen, func(e snapshotEntry) error {
+		check.Keys[typeName(e.obj.TypeEncoding)]++
+		if e.expireAt != 0 {
+			check.Expires++
+		}
+		return nil
+	})
+	if err != nil {
+		check.Err, check.ErrOffset = err, n
+	} else if n != check.Size {
+		check.Err, check.ErrOffset = fmt.Errorf("%d unexpected bytes after the checksum", check.Size-n), n
+	}
+	return check, nil
+}
+
+// typeName returns the name TYPE replies for the type of typeEncoding
+func typeName(typeEncoding uint8) string {
+	switch GetType(typeEncoding) {
+	case OBJ_TYPE_STRING:
+		return "string"
+	}
+	return "unknown"
+}
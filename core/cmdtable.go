@@ -0,0 +1,546 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Command flags, they describe how a command behaves so that the
+// dispatcher and the persistence layer do not have to know every command
+const CMD_WRITE uint32 = 1 << 0    // may modify the keyspace
+const CMD_READONLY uint32 = 1 << 1 // only reads the keyspace
+const CMD_DENYOOM uint32 = 1 << 2  // may grow the keyspace, refused when no key can be evicted
+const CMD_ADMIN uint32 = 1 << 3    // administrative command, such as BGREWRITEAOF
+const CMD_NOSCRIPT uint32 = 1 << 4 // not allowed from scripts
+const CMD_LOADING uint32 = 1 << 5  // allowed while the dataset is loading
+const CMD_STALE uint32 = 1 << 6    // allowed while the dataset is stale
+const CMD_FAST uint32 = 1 << 7     // runs in O(1) or O(log(N))
+
+// RedisCommand describes a command of the command table
+type RedisCommand struct {
+	// Name is the lower case name of the command
+	Name string
+	// Arity is the number of arguments including the command name,
+	// a negative arity -N means that at least N arguments are required
+	Arity int
+	Flags uint32
+	// FirstKey, LastKey and KeyStep are the positions of the keys in the
+	// arguments, the command name being at 0. A negative LastKey counts
+	// from the end, -1 being the last argument. FirstKey is 0 when the
+	// command takes no key.
+	FirstKey int
+	LastKey  int
+	KeyStep  int
+	Eval     func(args []string, c *Client) []byte
+
+	// documentation reported by COMMAND DOCS
+	Summary    string
+	Since      string
+	Group      string
+	Complexity string
+}
+
+// CheckArity reports whether the command can be called with argc arguments,
+// the command name included
+func (cmd *RedisCommand) CheckArity(argc int) bool {
+	if cmd.Arity >= 0 {
+		return argc == cmd.Arity
+	}
+	return argc >= -cmd.Arity
+}
+
+// Keys returns the keys of argv, the command line of cmd including its name
+func (cmd *RedisCommand) Keys(argv []string) []string {
+	if cmd.FirstKey == 0 || cmd.FirstKey >= len(argv) {
+		return nil
+	}
+	last := cmd.LastKey
+	if last < 0 {
+		last = len(argv) + last
+	}
+	var keys []string
+	for i := cmd.FirstKey; i <= last && i < len(argv); i += cmd.KeyStep {
+		keys = append(keys, argv[i])
+	}
+	return keys
+}
+
+// HasFlag reports whether all of flags are set on the command
+func (cmd *RedisCommand) HasFlag(flags uint32) bool {
+	return cmd.Flags&flags == flags
+}
+
+var commandTable map[string]*RedisCommand
+
+func init() {
+	commandTable = make(map[string]*RedisCommand)
+	for _, cmd := range []*RedisCommand{
+		{
+			Name: "ping", Arity: -1, Flags: CMD_FAST | CMD_STALE, Eval: evalPing,
+			Summary: "Returns the server's liveliness response.", Since: "1.0.0", Group: "connection", Complexity: "O(1)",
+		},
+		{
+			Name: "hello", Arity: -1, Flags: CMD_FAST | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE, Eval: evalHELLO,
+			Summary: "Handshakes with the server.", Since: "6.0.0", Group: "connection", Complexity: "O(1)",
+		},
+		{
+			Name: "command", Arity: -1, Flags: CMD_LOADING | CMD_STALE, Eval: evalCOMMAND,
+			Summary: "Returns detailed information about all commands.", Since: "2.8.13", Group: "server", Complexity: "O(N) where N is the total number of commands",
+		},
+		{
+			Name: "get", Arity: 2, Flags: CMD_READONLY | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalGET,
+			Summary: "Returns the string value of a key.", Since: "1.0.0", Group: "string", Complexity: "O(1)",
+		},
+		{
+			Name: "set", Arity: -3, Flags: CMD_WRITE | CMD_DENYOOM, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalSET,
+			Summary: "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist.", Since: "1.0.0", Group: "string", Complexity: "O(1)",
+		},
+		{
+			Name: "del", Arity: -2, Flags: CMD_WRITE, FirstKey: 1, LastKey: -1, KeyStep: 1, Eval: evalDEL,
+			Summary: "Deletes one or more keys.", Since: "1.0.0", Group: "generic", Complexity: "O(N) where N is the number of keys that will be removed.",
+		},
+		{
+			Name: "unlink", Arity: -2, Flags: CMD_WRITE | CMD_FAST, FirstKey: 1, LastKey: -1, KeyStep: 1, Eval: evalDEL,
+			Summary: "Asynchronously deletes one or more keys.", Since: "4.0.0", Group: "generic", Complexity: "O(1) for each key removed regardless of its size. Then the command does O(N) work in a different thread in order to reclaim memory, where N is the number of allocations the deleted objects where composed of.",
+		},
+		{
+			Name: "exists", Arity: -2, Flags: CMD_READONLY | CMD_FAST, FirstKey: 1, LastKey: -1, KeyStep: 1, Eval: evalEXISTS,
+			Summary: "Determines whether one or more keys exist.", Since: "1.0.0", Group: "generic", Complexity: "O(N) where N is the number of keys to check.",
+		},
+		{
+			Name: "type", Arity: 2, Flags: CMD_READONLY | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalTYPE,
+			Summary: "Determines the type of value stored at a key.", Since: "1.0.0", Group: "generic", Complexity: "O(1)",
+		},
+		{
+			Name: "rename", Arity: 3, Flags: CMD_WRITE, FirstKey: 1, LastKey: 2, KeyStep: 1, Eval: evalRENAME,
+			Summary: "Renames a key and overwrites the destination.", Since: "1.0.0", Group: "generic", Complexity: "O(1)",
+		},
+		{
+			Name: "renamenx", Arity: 3, Flags: CMD_WRITE | CMD_FAST, FirstKey: 1, LastKey: 2, KeyStep: 1, Eval: evalRENAMENX,
+			Summary: "Renames a key only when the target key name doesn't exist.", Since: "1.0.0", Group: "generic", Complexity: "O(1)",
+		},
+		{
+			Name: "copy", Arity: -3, Flags: CMD_WRITE | CMD_DENYOOM, FirstKey: 1, LastKey: 2, KeyStep: 1, Eval: evalCOPY,
+			Summary: "Copies the value of a key to a new key.", Since: "6.2.0", Group: "generic", Complexity: "O(N) worst case for collections, where N is the number of nested items. O(1) for string values.",
+		},
+		{
+			Name: "touch", Arity: -2, Flags: CMD_READONLY | CMD_FAST, FirstKey: 1, LastKey: -1, KeyStep: 1, Eval: evalTOUCH,
+			Summary: "Returns the number of existing keys out of those specified after updating the time they were last accessed.", Since: "3.2.1", Group: "generic", Complexity: "O(N) where N is the number of keys that will be touched.",
+		},
+		{
+			Name: "randomkey", Arity: 1, Flags: CMD_READONLY, Eval: evalRANDOMKEY,
+			Summary: "Returns a random key name from the database.", Since: "1.0.0", Group: "generic", Complexity: "O(1)",
+		},
+		{
+			Name: "keys", Arity: 2, Flags: CMD_READONLY, Eval: evalKEYS,
+			Summary: "Returns all key names that match a pattern.", Since: "1.0.0", Group: "generic", Complexity: "O(N) with N being the number of keys in the database, under the assumption that the key names in the database and the given pattern have limited length.",
+		},
+		{
+			Name: "scan", Arity: -2, Flags: CMD_READONLY, Eval: evalSCAN,
+			Summary: "Iterates over the key names in the database.", Since: "2.8.0", Group: "generic", Complexity: "O(1) for every call. O(N) for a complete iteration, including enough command calls for the cursor to return back to 0. N is the number of elements inside the collection.",
+		},
+		{
+			Name: "move", Arity: 3, Flags: CMD_WRITE | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalMOVE,
+			Summary: "Moves a key to another database.", Since: "1.0.0", Group: "generic", Complexity: "O(1)",
+		},
+		{
+			Name: "expire", Arity: -3, Flags: CMD_WRITE | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalEXPIRE,
+			Summary: "Sets the expiration time of a key in seconds.", Since: "1.0.0", Group: "generic", Complexity: "O(1)",
+		},
+		{
+			Name: "pexpire", Arity: -3, Flags: CMD_WRITE | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalPEXPIRE,
+			Summary: "Sets the expiration time of a key in milliseconds.", Since: "2.6.0", Group: "generic", Complexity: "O(1)",
+		},
+		{
+			Name: "expireat", Arity: -3, Flags: CMD_WRITE | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalEXPIREAT,
+			Summary: "Sets the expiration time of a key to a Unix timestamp.", Since: "1.2.0", Group: "generic", Complexity: "O(1)",
+		},
+		{
+			Name: "pexpireat", Arity: -3, Flags: CMD_WRITE | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalPEXPIREAT,
+			Summary: "Sets the expiration time of a key to a Unix milliseconds timestamp.", Since: "2.6.0", Group: "generic", Complexity: "O(1)",
+		},
+		{
+			Name: "ttl", Arity: 2, Flags: CMD_READONLY | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalTTL,
+			Summary: "Returns the expiration time in seconds of a key.", Since: "1.0.0", Group: "generic", Complexity: "O(1)",
+		},
+		{
+			Name: "pttl", Arity: 2, Flags: CMD_READONLY | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalPTTL,
+			Summary: "Returns the expiration time in milliseconds of a key.", Since: "2.6.0", Group: "generic", Complexity: "O(1)",
+		},
+		{
+			Name: "expiretime", Arity: 2, Flags: CMD_READONLY | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalEXPIRETIME,
+			Summary: "Returns the expiration time of a key as a Unix timestamp.", Since: "7.0.0", Group: "generic", Complexity: "O(1)",
+		},
+		{
+			Name: "pexpiretime", Arity: 2, Flags: CMD_READONLY | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalPEXPIRETIME,
+			Summary: "Returns the expiration time of a key as a Unix milliseconds timestamp.", Since: "7.0.0", Group: "generic", Complexity: "O(1)",
+		},
+		{
+			Name: "persist", Arity: 2, Flags: CMD_WRITE | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalPERSIST,
+			Summary: "Removes the expiration time of a key.", Since: "2.2.0", Group: "generic", Complexity: "O(1)",
+		},
+		{
+			Name: "mget", Arity: -2, Flags: CMD_READONLY | CMD_FAST, FirstKey: 1, LastKey: -1, KeyStep: 1, Eval: evalMGET,
+			Summary: "Atomically returns the string values of one or more keys.", Since: "1.0.0", Group: "string", Complexity: "O(N) where N is the number of keys to retrieve.",
+		},
+		{
+			Name: "mset", Arity: -3, Flags: CMD_WRITE | CMD_DENYOOM, FirstKey: 1, LastKey: -1, KeyStep: 2, Eval: evalMSET,
+			Summary: "Atomically creates or modifies the string values of one or more keys.", Since: "1.0.1", Group: "string", Complexity: "O(N) where N is the number of keys to set.",
+		},
+		{
+			Name: "msetnx", Arity: -3, Flags: CMD_WRITE | CMD_DENYOOM, FirstKey: 1, LastKey: -1, KeyStep: 2, Eval: evalMSETNX,
+			Summary: "Atomically modifies the string values of one or more keys only when all keys don't exist.", Since: "1.0.1", Group: "string", Complexity: "O(N) where N is the number of keys to set.",
+		},
+		{
+			Name: "setnx", Arity: 3, Flags: CMD_WRITE | CMD_DENYOOM | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalSETNX,
+			Summary: "Set the string value of a key only when the key doesn't exist.", Since: "1.0.0", Group: "string", Complexity: "O(1)",
+		},
+		{
+			Name: "setex", Arity: 4, Flags: CMD_WRITE | CMD_DENYOOM, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalSETEX,
+			Summary: "Sets the string value and expiration time of a key. Creates the key if it doesn't exist.", Since: "2.0.0", Group: "string", Complexity: "O(1)",
+		},
+		{
+			Name: "psetex", Arity: 4, Flags: CMD_WRITE | CMD_DENYOOM, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalPSETEX,
+			Summary: "Sets both string value and expiration time in milliseconds of a key. The key is created if it doesn't exist.", Since: "2.6.0", Group: "string", Complexity: "O(1)",
+		},
+		{
+			Name: "getdel", Arity: 2, Flags: CMD_WRITE | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalGETDEL,
+			Summary: "Returns the string value of a key after deleting the key.", Since: "6.2.0", Group: "string", Complexity: "O(1)",
+		},
+		{
+			Name: "getex", Arity: -2, Flags: CMD_WRITE | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalGETEX,
+			Summary: "Returns the string value of a key after setting its expiration time.", Since: "6.2.0", Group: "string", Complexity: "O(1)",
+		},
+		{
+			Name: "append", Arity: 3, Flags: CMD_WRITE | CMD_DENYOOM | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalAPPEND,
+			Summary: "Appends a string to the value of a key. Creates the key if it doesn't exist.", Since: "2.0.0", Group: "string", Complexity: "O(1). The amortized time complexity is O(1) assuming the appended value is small and the already present value is of any size, since the dynamic string library used by Redis will double the free space available on every reallocation.",
+		},
+		{
+			Name: "strlen", Arity: 2, Flags: CMD_READONLY | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalSTRLEN,
+			Summary: "Returns the length of a string value.", Since: "2.2.0", Group: "string", Complexity: "O(1)",
+		},
+		{
+			Name: "getrange", Arity: 4, Flags: CMD_READONLY, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalGETRANGE,
+			Summary: "Returns a substring of the string stored at a key.", Since: "2.4.0", Group: "string", Complexity: "O(N) where N is the length of the returned string. The complexity is ultimately determined by the returned length, but because creating a substring from an existing string is very cheap, it can be considered O(1) for small strings.",
+		},
+		{
+			Name: "setrange", Arity: 4, Flags: CMD_WRITE | CMD_DENYOOM, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalSETRANGE,
+			Summary: "Overwrites a part of a string value with another by an offset. Creates the key if it doesn't exist.", Since: "2.2.0", Group: "string", Complexity: "O(1), not counting the time taken to copy the new string in place. Usually, this string is very small so the amortized complexity is O(1). Otherwise, complexity is O(M) with M being the length of the value argument.",
+		},
+		{
+			Name: "lcs", Arity: -3, Flags: CMD_READONLY, FirstKey: 1, LastKey: 2, KeyStep: 1, Eval: evalLCS,
+			Summary: "Finds the longest common substring.", Since: "7.0.0", Group: "string", Complexity: "O(N*M) where N and M are the lengths of s1 and s2, respectively",
+		},
+		{
+			Name: "incr", Arity: 2, Flags: CMD_WRITE | CMD_DENYOOM | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalINCR,
+			Summary: "Increments the integer value of a key by one. Uses 0 as initial value if the key doesn't exist.", Since: "1.0.0", Group: "string", Complexity: "O(1)",
+		},
+		{
+			Name: "incrby", Arity: 3, Flags: CMD_WRITE | CMD_DENYOOM | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalINCRBY,
+			Summary: "Increments the integer value of a key by a number. Uses 0 as initial value if the key doesn't exist.", Since: "1.0.0", Group: "string", Complexity: "O(1)",
+		},
+		{
+			Name: "incrbyfloat", Arity: 3, Flags: CMD_WRITE | CMD_DENYOOM | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalINCRBYFLOAT,
+			Summary: "Increment the floating point value of a key by a number. Uses 0 as initial value if the key doesn't exist.", Since: "2.6.0", Group: "string", Complexity: "O(1)",
+		},
+		{
+			Name: "decr", Arity: 2, Flags: CMD_WRITE | CMD_DENYOOM | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalDECR,
+			Summary: "Decrements the integer value of a key by one. Uses 0 as initial value if the key doesn't exist.", Since: "1.0.0", Group: "string", Complexity: "O(1)",
+		},
+		{
+			Name: "decrby", Arity: 3, Flags: CMD_WRITE | CMD_DENYOOM | CMD_FAST, FirstKey: 1, LastKey: 1, KeyStep: 1, Eval: evalDECRBY,
+			Summary: "Decrements a number from the integer value of a key. Uses 0 as initial value if the key doesn't exist.", Since: "1.0.0", Group: "string", Complexity: "O(1)",
+		},
+		{
+			Name: "bgrewriteaof", Arity: 1, Flags: CMD_ADMIN | CMD_NOSCRIPT, Eval: evalBGREWRITEAOF,
+			Summary: "Asynchronously rewrites the append-only file to disk.", Since: "1.0.0", Group: "server", Complexity: "O(1)",
+		},
+		{
+			Name: "save", Arity: 1, Flags: CMD_ADMIN | CMD_NOSCRIPT, Eval: evalSAVE,
+			Summary: "Synchronously saves the database(s) to disk.", Since: "1.0.0", Group: "server", Complexity: "O(N) where N is the total number of keys in all databases",
+		},
+		{
+			Name: "bgsave", Arity: -1, Flags: CMD_ADMIN | CMD_NOSCRIPT, Eval: evalBGSAVE,
+			Summary: "Asynchronously saves the database(s) to disk.", Since: "1.0.0", Group: "server", Complexity: "O(1)",
+		},
+		{
+			Name: "lastsave", Arity: 1, Flags: CMD_LOADING | CMD_STALE | CMD_FAST, Eval: evalLASTSAVE,
+			Summary: "Returns the Unix timestamp of the last successful save to disk.", Since: "1.0.0", Group: "server", Complexity: "O(1)",
+		},
+		{
+			Name: "select", Arity: 2, Flags: CMD_LOADING | CMD_STALE | CMD_FAST, Eval: evalSELECT,
+			Summary: "Changes the selected database.", Since: "1.0.0", Group: "connection", Complexity: "O(1)",
+		},
+		{
+			Name: "swapdb", Arity: 3, Flags: CMD_WRITE | CMD_FAST, Eval: evalSWAPDB,
+			Summary: "Swaps two Redis databases.", Since: "4.0.0", Group: "server", Complexity: "O(N) where N is the count of clients watching or blocking on keys from both databases.",
+		},
+		{
+			Name: "flushdb", Arity: -1, Flags: CMD_WRITE, Eval: evalFLUSHDB,
+			Summary: "Remove all keys from the current database.", Since: "1.0.0", Group: "server", Complexity: "O(N) where N is the number of keys in the selected database",
+		},
+		{
+			Name: "flushall", Arity: -1, Flags: CMD_WRITE, Eval: evalFLUSHALL,
+			Summary: "Removes all keys from all databases.", Since: "1.0.0", Group: "server", Complexity: "O(N) where N is the total number of keys in all databases",
+		},
+		{
+			Name: "dbsize", Arity: 1, Flags: CMD_READONLY | CMD_FAST, Eval: evalDBSIZE,
+			Summary: "Returns the number of keys in the database.", Since: "1.0.0", Group: "server", Complexity: "O(1)",
+		},
+		{
+			Name: "info", Arity: -1, Flags: CMD_LOADING | CMD_STALE, Eval: evalINFO,
+			Summary: "Returns information and statistics about the server.", Since: "1.0.0", Group: "server", Complexity: "O(1)",
+		},
+		{
+			Name: "client", Arity: -2, Flags: CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE, Eval: evalCLIENT,
+			Summary: "A container for client connection commands.", Since: "2.4.0", Group: "connection", Complexity: "Depends on subcommand.",
+		},
+		{
+			Name: "latency", Arity: -2, Flags: CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE, Eval: evalLATENCY,
+			Summary: "A container for latency diagnostics commands.", Since: "2.8.13", Group: "server", Complexity: "Depends on subcommand.",
+		},
+		{
+			Name: "lru", Arity: 1, Flags: CMD_ADMIN | CMD_NOSCRIPT, Eval: evalLRU,
+			Summary: "Runs the eviction of the configured strategy.", Since: "0.0.1", Group: "server", Complexity: "O(N) where N is the number of evicted keys",
+		},
+		{
+			Name: "multi", Arity: 1, Flags: CMD_NOSCRIPT | CMD_LOADING | CMD_STALE | CMD_FAST, Eval: evalMULTI,
+			Summary: "Starts a transaction.", Since: "1.2.0", Group: "transactions", Complexity: "O(1)",
+		},
+		{
+			Name: "exec", Arity: 1, Flags: CMD_NOSCRIPT | CMD_LOADING | CMD_STALE, Eval: evalEXEC,
+			Summary: "Executes all commands in a transaction.", Since: "1.2.0", Group: "transactions", Complexity: "Depends on commands in the transaction",
+		},
+		{
+			Name: "discard", Arity: 1, Flags: CMD_NOSCRIPT | CMD_LOADING | CMD_STALE | CMD_FAST, Eval: evalDISCARD,
+			Summary: "Discards a transaction.", Since: "2.0.0", Group: "transactions", Complexity: "O(N), when N is the number of queued commands",
+		},
+	} {
+		commandTable[cmd.Name] = cmd
+	}
+}
+
+// LookupCommand returns the command called name, ignoring the case,
+// or nil when there is no such command
+func LookupCommand(name string) *RedisCommand {
+	return commandTable[strings.ToLower(name)]
+}
+
+// flagNames maps the command flags to the names reported by COMMAND
+var flagNames = []struct {
+	flag uint32
+	name string
+}{
+	{CMD_WRITE, "write"},
+	{CMD_READONLY, "readonly"},
+	{CMD_DENYOOM, "denyoom"},
+	{CMD_ADMIN, "admin"},
+	{CMD_NOSCRIPT, "noscript"},
+	{CMD_LOADING, "loading"},
+	{CMD_STALE, "stale"},
+	{CMD_FAST, "fast"},
+}
+
+// groupCategories maps the documentation groups to ACL categories
+var groupCategories = map[string]string{
+	"string":       "@string",
+	"generic":      "@keyspace",
+	"connection":   "@connection",
+	"transactions": "@transaction",
+}
+
+// sortedCommands returns the command table ordered by name
+func sortedCommands() []*RedisCommand {
+	cmds := make([]*RedisCommand, 0, len(commandTable))
+	for _, cmd := range commandTable {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// info returns the description of the command as replied by COMMAND INFO
+func (cmd *RedisCommand) info() []interface{} {
+	flags := Set{}
+	for _, f := range flagNames {
+		if cmd.HasFlag(f.flag) {
+			flags = append(flags, f.name)
+		}
+	}
+
+	categories := Set{}
+	switch {
+	case cmd.HasFlag(CMD_WRITE):
+		categories = append(categories, "@write")
+	case cmd.HasFlag(CMD_READONLY):
+		categories = append(categories, "@read")
+	}
+	if cmd.HasFlag(CMD_ADMIN) {
+		categories = append(categories, "@admin", "@dangerous")
+	}
+	if category, ok := groupCategories[cmd.Group]; ok {
+		categories = append(categories, category)
+	}
+	if cmd.HasFlag(CMD_FAST) {
+		categories = append(categories, "@fast")
+	} else {
+		categories = append(categories, "@slow")
+	}
+
+	return []interface{}{
+		cmd.Name,
+		cmd.Arity,
+		flags,
+		cmd.FirstKey,
+		cmd.LastKey,
+		cmd.KeyStep,
+		categories,
+		[]interface{}{},
+		cmd.keySpecs(),
+		[]interface{}{},
+	}
+}
+
+// keySpecs describes the key positions in the key specifications
+// format of redis 7, derived from FirstKey, LastKey and KeyStep
+func (cmd *RedisCommand) keySpecs() []interface{} {
+	if cmd.FirstKey == 0 {
+		return []interface{}{}
+	}
+
+	flags := Set{"RO", "ACCESS"}
+	if cmd.HasFlag(CMD_WRITE) {
+		flags = Set{"RW", "UPDATE"}
+	}
+	// lastkey is relative to the first key when positive
+	lastKey := cmd.LastKey
+	if lastKey >= 0 {
+		lastKey -= cmd.FirstKey
+	}
+
+	return []interface{}{
+		Map{
+			{"flags", flags},
+			{"begin_search", Map{
+				{"type", "index"},
+				{"spec", Map{{"index", cmd.FirstKey}}},
+			}},
+			{"find_keys", Map{
+				{"type", "range"},
+				{"spec", Map{{"lastkey", lastKey}, {"keystep", cmd.KeyStep}, {"limit", 0}}},
+			}},
+		},
+	}
+}
+
+// docs returns the documentation of the command as replied by COMMAND DOCS
+func (cmd *RedisCommand) docs() Map {
+	return Map{
+		{"summary", cmd.Summary},
+		{"since", cmd.Since},
+		{"group", cmd.Group},
+		{"complexity", cmd.Complexity},
+	}
+}
+
+var commandHelp = []string{
+	"COMMAND <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"(no subcommand)",
+	"    Return details about all commands.",
+	"COUNT",
+	"    Return the total number of commands in this server.",
+	"LIST",
+	"    Return a list of all commands in this server.",
+	"INFO [<command-name> ...]",
+	"    Return details about multiple commands.",
+	"    If no command names are given, documentation details for all",
+	"    commands are returned.",
+	"DOCS [<command-name> ...]",
+	"    Return documentation details about multiple commands.",
+	"    If no command names are given, documentation details for all",
+	"    commands are returned.",
+	"GETKEYS <full-command>",
+	"    Return the keys from a full command.",
+	"HELP",
+	"    Print this help.",
+}
+
+// evalCOMMAND introspects the command table
+// COMMAND [COUNT | LIST | INFO [name ...] | DOCS [name ...] | GETKEYS command [arg ...] | HELP]
+func evalCOMMAND(args []string, c *Client) []byte {
+	if len(args) == 0 {
+		var reply []interface{}
+		for _, cmd := range sortedCommands() {
+			reply = append(reply, cmd.info())
+		}
+		return EncodeProto(reply, false, c.proto)
+	}
+
+	sub := strings.ToUpper(args[0])
+	switch {
+	case sub == "COUNT" && len(args) == 1:
+		return Encode(len(commandTable), false)
+
+	case sub == "LIST" && len(args) == 1:
+		var names []string
+		for _, cmd := range sortedCommands() {
+			names = append(names, cmd.Name)
+		}
+		return Encode(names, false)
+
+	case sub == "INFO":
+		var reply []interface{}
+		if len(args) == 1 {
+			for _, cmd := range sortedCommands() {
+				reply = append(reply, cmd.info())
+			}
+		}
+		for _, name := range args[1:] {
+			if cmd := LookupCommand(name); cmd != nil {
+				reply = append(reply, cmd.info())
+			} else {
+				reply = append(reply, nil)
+			}
+		}
+		return EncodeProto(reply, false, c.proto)
+
+	case sub == "DOCS":
+		reply := Map{}
+		if len(args) == 1 {
+			for _, cmd := range sortedCommands() {
+				reply = append(reply, KV{cmd.Name, cmd.docs()})
+			}
+		}
+		for _, name := range args[1:] {
+			if cmd := LookupCommand(name); cmd != nil {
+				reply = append(reply, KV{cmd.Name, cmd.docs()})
+			}
+		}
+		return EncodeProto(reply, false, c.proto)
+
+	case sub == "GETKEYS" && len(args) >= 2:
+		cmd := LookupCommand(args[1])
+		if cmd == nil {
+			return Encode(errors.New("ERR Invalid command specified"), false)
+		}
+		if !cmd.CheckArity(len(args) - 1) {
+			return Encode(errors.New("ERR Invalid number of arguments specified for command"), false)
+		}
+		keys := cmd.Keys(args[1:])
+		if len(keys) == 0 {
+			return Encode(errors.New("ERR The command has no key arguments"), false)
+		}
+		return Encode(keys, false)
+
+	case sub == "HELP" && len(args) == 1:
+		var reply []interface{}
+		for _, line := range commandHelp {
+			reply = append(reply, line)
+		}
+		return EncodeProto(reply, false, c.proto)
+	}
+
+	return Encode(fmt.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'. Try COMMAND HELP.", args[0]), false)
+}
@@ -2,16 +2,59 @@ package core
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"sync/atomic"
 	"syscall"
 )
 
+// ioBufLen is the number of bytes read from the socket in one shot
+const ioBufLen = 16 * 1024
+
+// nextClientID is the id given to the next connected client
+var nextClientID int64 = 1
+
 type Client struct {
 	io.ReadWriter
 	Fd     int
+	ID     int64
+	Name   string
 	cqueue RedisCmds
 	isTxn  bool
+	// isTxnDirty is set when a command could not be queued,
+	// the transaction is then aborted by EXEC
+	isTxnDirty bool
+	// isTxnPropagated is set once the MULTI of the transaction
+	// being executed has been written to the AOF
+	isTxnPropagated bool
+	// propagateAs, when set by the command being executed, replaces its
+	// command line in the AOF, typically to turn a relative TTL into an
+	// absolute one that does not restart on reload
+	propagateAs [][]string
+	// proto is the RESP version negotiated with HELLO
+	proto int
+	// store is the instance the client is connected to and db the
+	// database of it selected with SELECT
+	store *Store
+	db    *DB
+	// queryBuf accumulates the bytes read from the socket until
+	// they form complete frames
+	queryBuf []byte
+	// multibulk is the request array being decoded, the elements already
+	// received are kept across the reads so that they are decoded once
+	multibulk multibulkState
+}
+
+// multibulkState is the progress of the decoding of a request array
+type multibulkState struct {
+	// remaining is the number of elements still expected, 0 when no
+	// array is being decoded
+	remaining int
+	// bulkLen is the length of the bulk string whose header has been
+	// read, -1 until then
+	bulkLen  int
+	elements []interface{}
 }
 
 func (c Client) Write(b []byte) (int, error) {
@@ -22,6 +65,145 @@ func (c Client) Read(b []byte) (int, error) {
 	return syscall.Read(c.Fd, b)
 }
 
+// ReadQuery reads the bytes available on the socket and appends
+// them to the query buffer of the client
+func (c *Client) ReadQuery() error {
+	if len(c.queryBuf) > c.store.config.ClientQueryBufferLimit {
+		return errors.New("query buffer limit exceeded")
+	}
+
+	if cap(c.queryBuf)-len(c.queryBuf) < ioBufLen {
+		buf := make([]byte, len(c.queryBuf), 2*cap(c.queryBuf)+ioBufLen)
+		copy(buf, c.queryBuf)
+		c.queryBuf = buf
+	}
+
+	n, err := c.Read(c.queryBuf[len(c.queryBuf):cap(c.queryBuf)])
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		// spurious wake up, nothing to read yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return io.EOF
+	}
+	c.queryBuf = c.queryBuf[:len(c.queryBuf)+n]
+	return nil
+}
+
+// DecodeQuery decodes every complete frame present in the query buffer.
+// A trailing partial frame is kept in the buffer for the next read. On a
+// malformed frame the values preceding it are returned along with the error.
+func (c *Client) DecodeQuery() ([]interface{}, error) {
+	var values []interface{}
+	pos := 0
+	for pos < len(c.queryBuf) {
+		var value interface{}
+		var delta int
+		var err error
+		// requests are RESP arrays, anything else is an inline command
+		if c.multibulk.remaining > 0 || c.queryBuf[pos] == '*' {
+			value, delta, err = c.decodeMultibulk(c.queryBuf[pos:])
+		} else {
+			value, delta, err = readInline(c.queryBuf[pos:])
+		}
+		if err == ErrIncomplete {
+			pos += delta
+			break
+		}
+		if err != nil {
+			c.queryBuf = nil
+			c.multibulk = multibulkState{}
+			return values, err
+		}
+		values = append(values, value)
+		pos += delta
+	}
+
+	// move the unconsumed bytes to the front, and let go of the
+	// memory once a large request has been fully consumed
+	if pos > 0 {
+		n := copy(c.queryBuf, c.queryBuf[pos:])
+		c.queryBuf = c.queryBuf[:n]
+	}
+	if len(c.queryBuf) == 0 && cap(c.queryBuf) > 2*ioBufLen {
+		c.queryBuf = nil
+	}
+	return values, nil
+}
+
+// decodeMultibulk decodes a request array of bulk strings from data,
+// resuming the array left incomplete by the previous call if any. Unlike
+// DecodeOne, it returns with ErrIncomplete the number of bytes consumed
+// into the state of the client, they must not be passed again.
+func (c *Client) decodeMultibulk(data []byte) (interface{}, int, error) {
+	mb := &c.multibulk
+	pos := 0
+	if mb.remaining == 0 {
+		count, delta, err := readLength(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		if count > maxArrayLen {
+			return nil, 0, &ProtocolError{"invalid multibulk length"}
+		}
+		// an empty or null array is a no-op
+		if count <= 0 {
+			return []interface{}{}, delta, nil
+		}
+		// do not trust the announced count for the allocation
+		capacity := count
+		if capacity > 1024 {
+			capacity = 1024
+		}
+		*mb = multibulkState{remaining: count, bulkLen: -1, elements: make([]interface{}, 0, capacity)}
+		pos = delta
+	}
+
+	maxBulkLen := c.store.config.ProtoMaxBulkLen
+	for mb.remaining > 0 {
+		if mb.bulkLen == -1 {
+			if pos == len(data) {
+				return nil, pos, ErrIncomplete
+			}
+			if data[pos] != '$' {
+				return nil, 0, &ProtocolError{fmt.Sprintf("expected '$', got '%c'", data[pos])}
+			}
+			n, delta, err := readLength(data[pos:])
+			if err == ErrIncomplete {
+				return nil, pos, err
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			if n < 0 || n > maxBulkLen {
+				return nil, 0, &ProtocolError{"invalid bulk length"}
+			}
+			mb.bulkLen = n
+			pos += delta
+		}
+
+		// the payload and its trailing CRLF may not have arrived yet
+		end := pos + mb.bulkLen
+		if end+2 > len(data) {
+			return nil, pos, ErrIncomplete
+		}
+		if data[end] != '\r' || data[end+1] != '\n' {
+			return nil, 0, &ProtocolError{"expected CRLF after bulk string"}
+		}
+		mb.elements = append(mb.elements, string(data[pos:end]))
+		pos = end + 2
+		mb.bulkLen = -1
+		mb.remaining--
+	}
+
+	elements := mb.elements
+	mb.elements = nil
+	return elements, pos, nil
+}
+
 func (c *Client) TxnBegin() {
 	c.isTxn = true
 }
@@ -34,9 +216,14 @@ func (c *Client) TxnExec() []byte {
 	for _, _cmd := range c.cqueue {
 		buf.Write(executeCommand(_cmd, c))
 	}
+	if c.isTxnPropagated {
+		c.store.feedAppendOnlyFile([]string{"EXEC"}, c)
+		c.isTxnPropagated = false
+	}
 
 	c.cqueue = make(RedisCmds, 0)
 	c.isTxn = false
+	c.isTxnDirty = false
 
 	return buf.Bytes()
 }
@@ -44,15 +231,35 @@ func (c *Client) TxnExec() []byte {
 func (c *Client) TxnDiscard() {
 	c.cqueue = make(RedisCmds, 0)
 	c.isTxn = false
+	c.isTxnDirty = false
 }
 
 func (c *Client) TxnQueue(cmd *RedisCmd) {
 	c.cqueue = append(c.cqueue, cmd)
 }
 
-func NewClient(fd int) *Client {
+// Proto returns the RESP version the client speaks
+func (c *Client) Proto() int {
+	return c.proto
+}
+
+// Push sends an out of band message to the client, as a push frame
+// to RESP3 clients and as a plain array to RESP2 ones
+func (c *Client) Push(values ...interface{}) error {
+	_, err := c.Write(EncodeProto(Push(values), false, c.proto))
+	return err
+}
+
+// NewClient returns a client of s connected through fd, -1 for the
+// clients without a connection
+func (s *Store) NewClient(fd int) *Client {
+	id := atomic.AddInt64(&nextClientID, 1) - 1
 	return &Client{
 		Fd:     fd,
+		ID:     id,
 		cqueue: make(RedisCmds, 0),
+		proto:  RESP2,
+		store:  s,
+		db:     s.dbs[0],
 	}
 }
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDecodeQueryInChunks(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	c := s.NewClient(-1)
+
+	argv := []string{"MGET"}
+	for i := 0; i < 80000; i++ {
+		argv = append(argv, fmt.Sprintf("key:%d", i))
+	}
+	query := append(Encode(argv, false), "PING\r\n"...)
+
+	var values []interface{}
+	for len(query) > 0 {
+		n := 4096
+		if n > len(query) {
+			n = len(query)
+		}
+		c.queryBuf = append(c.queryBuf, query[:n]...)
+		query = query[n:]
+
+		decoded, err := c.DecodeQuery()
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, decoded...)
+		// the elements are consumed as they arrive, only a partial
+		// element is left for the next read
+		if len(c.queryBuf) > 64 {
+			t.Fatalf("%d bytes are left in the query buffer", len(c.queryBuf))
+		}
+	}
+
+	if len(values) != 2 {
+		t.Fatalf("%d values were decoded", len(values))
+	}
+	elements := values[0].([]interface{})
+	if len(elements) != len(argv) || elements[0] != "MGET" || elements[len(elements)-1] != "key:79999" {
+		t.Fatalf("the array was not decoded whole: %d elements", len(elements))
+	}
+	if fmt.Sprint(values[1]) != "[PING]" {
+		t.Fatalf("unexpected inline command %v", values[1])
+	}
+}
+
+func TestDecodeQueryErrors(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	c := s.NewClient(-1)
+
+	for _, query := range []string{"*2\r\n$3\r\nGET\r\n:1\r\n", "*1\r\n$3\r\nGETX\r\n", "*1\r\n$-1\r\n"} {
+		// the error is found whether the array arrives at once or not
+		for _, split := range []int{len(query), len(query) / 2} {
+			c.queryBuf = []byte(query[:split])
+			_, err := c.DecodeQuery()
+			if err == nil && split < len(query) {
+				c.queryBuf = append(c.queryBuf, query[split:]...)
+				_, err = c.DecodeQuery()
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), "ERR Protocol error") {
+				t.Fatalf("%q: expected a protocol error got %v", query, err)
+			}
+			if c.multibulk.remaining != 0 {
+				t.Fatalf("%q: the array was not reset", query)
+			}
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,99 +18,146 @@ var RESP_ONE []byte = []byte(":1\r\n")
 var RESP_MINUS_1 []byte = []byte(":-1\r\n")
 var RESP_MINUS_2 []byte = []byte(":-2\r\n")
 
+// txnCommands are executed right away instead of being queued
+// while a transaction is in progress
 var txnCommands map[string]bool
 
 func init() {
-	txnCommands = map[string]bool{"EXEC": true, "DISCARD": true}
+	txnCommands = map[string]bool{"exec": true, "discard": true, "multi": true}
 }
 
-func evalMULTI(args []string) []byte {
+func evalMULTI(args []string, c *Client) []byte {
+	if c.isTxn {
+		return Encode(errors.New("ERR MULTI calls can not be nested"), false)
+	}
+	c.TxnBegin()
 	return RESP_OK
 }
 
+func evalEXEC(args []string, c *Client) []byte {
+	if !c.isTxn {
+		return Encode(errors.New("ERR EXEC without MULTI"), false)
+	}
+	if c.isTxnDirty {
+		c.TxnDiscard()
+		return Encode(errors.New("EXECABORT Transaction discarded because of previous errors."), false)
+	}
+	return c.TxnExec()
+}
+
+func evalDISCARD(args []string, c *Client) []byte {
+	if !c.isTxn {
+		return Encode(errors.New("ERR DISCARD without MULTI"), false)
+	}
+	c.TxnDiscard()
+	return RESP_OK
+}
+
+// executeCommand looks cmd up in the command table, checks its arity
+// and runs it
 func executeCommand(cmd *RedisCmd, c *Client) []byte {
-	switch cmd.Cmd {
-	case "PING":
-		return evalPing(cmd.Args)
-	case "SET":
-		return evalSET(cmd.Args)
-	case "GET":
-		return evalGET(cmd.Args)
-	case "TTL":
-		return evalTTL(cmd.Args)
-	case "DEL":
-		return evalDEL(cmd.Args)
-	case "EXPIRE":
-		return evalEXPIRE(cmd.Args)
-	case "BGREWRITEAOF":
-		return evalBGREWRITEAOF(cmd.Args)
-	case "INCR":
-		return evalINCR(cmd.Args)
-	case "INFO":
-		return evalINFO(cmd.Args)
-	case "CLIENT":
-		return evalCLIENT(cmd.Args)
-	case "LATENCY":
-		return evalLATENCY(cmd.Args)
-	case "LRU":
-		Evict()
-		return RESP_OK
-	case "MULTI":
-		c.TxnBegin()
-		return evalMULTI(cmd.Args)
-	case "EXEC":
-		if !c.isTxn {
-			return Encode(errors.New("ERR EXEC without MULTI"), false)
-		}
-		return c.TxnExec()
-	case "DISCARD":
-		if !c.isTxn {
-			return Encode(errors.New("ERR DISCARD without MULTI"), false)
+	command, err := lookupAndCheck(cmd)
+	if err != nil {
+		return Encode(err, false)
+	}
+
+	s := c.store
+	// at the keys limit, the commands that may add a key are refused
+	// when no key can be evicted to make room for it
+	if command.HasFlag(CMD_DENYOOM) && !s.loading && s.totalKeys() >= s.config.KeysLimit && !s.canEvict() {
+		return Encode(errOOM, false)
+	}
+
+	dirtyBefore := s.dirty
+	c.propagateAs = nil
+	reply := command.Eval(cmd.Args, c)
+
+	// log the write commands that changed the keyspace
+	if command.HasFlag(CMD_WRITE) && s.dirty != dirtyBefore {
+		if c.propagateAs == nil {
+			argv := make([]string, 0, len(cmd.Args)+1)
+			argv = append(argv, cmd.Cmd)
+			argv = append(argv, cmd.Args...)
+			s.feedAppendOnlyFile(argv, c)
+		}
+		for _, argv := range c.propagateAs {
+			s.feedAppendOnlyFile(argv, c)
 		}
-		c.TxnDiscard()
-		return RESP_OK
-	default:
-		return evalPing(cmd.Args)
 	}
+	return reply
+}
+
+// propagateAs replaces the command line of the command being executed
+// by argvs in the AOF
+func propagateAs(c *Client, argvs ...[]string) {
+	c.propagateAs = argvs
 }
 
-func executeCommandToBuffer(cmd *RedisCmd, buf *bytes.Buffer, c *Client) {
-	buf.Write(executeCommand(cmd, c))
+// lookupAndCheck returns the command cmd refers to, or the error to reply
+// when the command does not exist or is called with a wrong number of arguments
+func lookupAndCheck(cmd *RedisCmd) (*RedisCommand, error) {
+	command := LookupCommand(cmd.Cmd)
+	if command == nil {
+		var args strings.Builder
+		for _, arg := range cmd.Args {
+			args.WriteString(fmt.Sprintf("'%s' ", arg))
+		}
+		return nil, fmt.Errorf("ERR unknown command '%s', with args beginning with: %s", cmd.Cmd, args.String())
+	}
+	if !command.CheckArity(len(cmd.Args) + 1) {
+		return nil, fmt.Errorf("ERR wrong number of arguments for '%s' command", command.Name)
+	}
+	return command, nil
 }
 
 func EvalAndRespond(cmds RedisCmds, c *Client) {
 	var response []byte
 	buf := bytes.NewBuffer(response)
 
+	c.store.mu.Lock()
 	for _, cmd := range cmds {
-		// if txn is not in progress, then we can simply
-		// execute the command and add the response to the buffer
-		if !c.isTxn {
-			executeCommandToBuffer(cmd, buf, c)
-			continue
-		}
-
-		// if the txn is in progress, we enqueue the command
-		// and add the QUEUED response to the buffer
-		if !txnCommands[cmd.Cmd] {
-			// if the command is queuable the enqueu
-			c.TxnQueue(cmd)
-			buf.Write(RESP_QUEUED)
-		} else {
-			// if txn is active and the command is non-queuable
-			// ex: EXEC, DISCARD
-			// we execute the command and gather the response in buffer
-			executeCommandToBuffer(cmd, buf, c)
-		}
+		buf.Write(processCommand(cmd, c))
 	}
+	c.store.flushAppendOnlyFile()
+	c.store.mu.Unlock()
 	c.Write(buf.Bytes())
 }
 
-func evalPing(args []string) []byte {
+// processCommand runs cmd, or queues it when a transaction is in
+// progress, and returns the reply
+func processCommand(cmd *RedisCmd, c *Client) []byte {
+	// if txn is not in progress, then we can simply
+	// execute the command and return the response
+	if !c.isTxn {
+		return executeCommand(cmd, c)
+	}
+
+	// commands that can not run abort the transaction
+	// but the error is reported right away
+	command, err := lookupAndCheck(cmd)
+	if err != nil {
+		c.isTxnDirty = true
+		return Encode(err, false)
+	}
+
+	// if the txn is in progress, we enqueue the command
+	// and return the QUEUED response
+	if !txnCommands[command.Name] {
+		c.TxnQueue(cmd)
+		return RESP_QUEUED
+	}
+
+	// if txn is active and the command is non-queuable
+	// ex: EXEC, DISCARD
+	// we execute the command and return its response
+	return executeCommand(cmd, c)
+}
+
+func evalPing(args []string, c *Client) []byte {
 	var b []byte
 
 	if len(args) >= 2 {
-		return Encode(errors.New("ERR wrong number of arguments for PING command"), false)
+		return Encode(errors.New("ERR wrong number of arguments for 'ping' command"), false)
 	}
 
 	if len(args) == 0 {
@@ -121,163 +169,1312 @@ func evalPing(args []string) []byte {
 	return b
 }
 
-func evalGET(args []string) []byte {
-	if len(args) == 0 {
-		return Encode(errors.New("(error) wrong number of arguments for GET command"), false)
+// evalHELLO switches the protocol version of the client and
+// replies with a description of the server and the connection
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func evalHELLO(args []string, c *Client) []byte {
+	proto := c.proto
+	if len(args) > 0 {
+		v, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return Encode(errors.New("ERR Protocol version is not an integer or out of range"), false)
+		}
+		if v != int64(RESP2) && v != int64(RESP3) {
+			return Encode(errors.New("NOPROTO unsupported protocol version"), false)
+		}
+		proto = int(v)
 	}
 
-	obj := Get(args[0])
-	if obj == nil {
-		return []byte("+nil\r\n")
+	name := c.Name
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				return Encode(fmt.Errorf("ERR Syntax error in HELLO option '%s'", args[i]), false)
+			}
+			// there is no ACL, the default user can log in with any password
+			if args[i+1] != "default" {
+				return Encode(errors.New("WRONGPASS invalid username-password pair or user is disabled."), false)
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return Encode(fmt.Errorf("ERR Syntax error in HELLO option '%s'", args[i]), false)
+			}
+			if strings.ContainsAny(args[i+1], " \n") {
+				return Encode(errors.New("ERR Client names cannot contain spaces, newlines or special characters."), false)
+			}
+			name = args[i+1]
+			i++
+		default:
+			return Encode(fmt.Errorf("ERR Syntax error in HELLO option '%s'", args[i]), false)
+		}
 	}
 
-	if HasExpired(obj) {
-		return RESP_NIL
-	}
+	c.proto = proto
+	c.Name = name
 
-	return Encode(obj.Value, false)
+	// clients expect a redis server, so it is what we claim to be
+	return EncodeProto(Map{
+		{"server", "redis"},
+		{"version", "7.0.0"},
+		{"proto", proto},
+		{"id", c.ID},
+		{"mode", "standalone"},
+		{"role", "master"},
+		{"modules", []interface{}{}},
+	}, false, proto)
 }
 
-func evalSET(args []string) []byte {
-	if len(args) <= 1 {
-		return Encode(errors.New("(error) wrong number of arguments for SET command"), false)
+func evalGET(args []string, c *Client) []byte {
+	// a missing key is a null, that a client can tell apart from any
+	// string value
+	obj := c.db.Get(args[0])
+	if obj == nil {
+		return EncodeProto(nil, false, c.proto)
 	}
+	return Encode(getString(obj), false)
+}
 
-	var key, value string
-	// Don't expire
-	var exDurationMs int64 = -1
-	key, value = args[0], args[1]
-	oType, oEnc := DeduceTypeEncoding(value)
+// evalSET sets key to value
+// SET key value [NX | XX] [GET] [EX seconds | PX milliseconds |
+// EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
+func evalSET(args []string, c *Client) []byte {
+	key, value := args[0], args[1]
+	var nx, xx, get, keepTTL bool
+	// expiry is the unit of the expiry option, "" when there is none
+	var expiry string
+	var expireAt int64
 
 	for i := 2; i < len(args); i++ {
-		switch args[i] {
-		case "EX", "ex":
-			i++
-			if i == len(args) {
-				return Encode(errors.New("(error) Invalid syntax error"), false)
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GET":
+			get = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if expiry != "" || i+1 == len(args) {
+				return Encode(errors.New("ERR syntax error"), false)
 			}
-
-			exDurationSec, err := strconv.ParseInt(args[i], 10, 64)
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
 			if err != nil {
 				return Encode(errors.New("ERR value is not an integer or out of range"), false)
 			}
-			exDurationMs = exDurationSec * 1000
+			if expireAt, err = parseExpireAt(opt, n); err != nil {
+				return Encode(fmt.Errorf("ERR invalid expire time in '%s' command", "set"), false)
+			}
+			expiry = opt
 		default:
-			return Encode(errors.New("(error) Invalid syntax"), false)
+			return Encode(errors.New("ERR syntax error"), false)
+		}
+	}
+	if (nx && xx) || (keepTTL && expiry != "") {
+		return Encode(errors.New("ERR syntax error"), false)
+	}
+
+	old := c.db.Get(key)
+	reply := RESP_OK
+	if get {
+		reply = EncodeProto(nil, false, c.proto)
+		if old != nil {
+			reply = Encode(getString(old), false)
+		}
+	}
+	if (nx && old != nil) || (xx && old == nil) {
+		if get {
+			return reply
 		}
+		return EncodeProto(nil, false, c.proto)
 	}
+
+	setKey(c, key, value, expireAt, keepTTL)
+	return reply
+}
+
+// setKey sets key to the string value in the database of c, expiring at
+// the unix time in milliseconds expireAt unless it is 0. The TTL of the
+// replaced value is kept when keepTTL is set.
+func setKey(c *Client, key, value string, expireAt int64, keepTTL bool) {
 	// putting key and value in hash table
-	Put(key, NewObj(value, exDurationMs, oType, oEnc))
-	return []byte("+OK\r\n")
+	obj := newStringObj(value)
+	c.db.put(key, obj, keepTTL)
+	if expireAt != 0 {
+		c.db.setExpireAt(obj, uint64(expireAt))
+	}
+
+	// the conditions were checked, the AOF only needs the outcome
+	argv := []string{"SET", key, value}
+	if exp, ok := c.db.getExpiry(obj); ok {
+		argv = append(argv, "PXAT", strconv.FormatUint(exp, 10))
+	}
+	propagateAs(c, argv)
 }
 
-func evalTTL(args []string) []byte {
-	if len(args) == 0 {
-		return Encode(errors.New("(error) wrong number of arguments for TTL command"), false)
+// parseExpireAt returns the absolute unix time in milliseconds of the
+// expiry option opt, EX, PX, EXAT or PXAT, with the argument n
+func parseExpireAt(opt string, n int64) (int64, error) {
+	if n <= 0 {
+		return 0, errors.New("invalid expire time")
+	}
+	if opt == "EX" || opt == "EXAT" {
+		if n > math.MaxInt64/1000 {
+			return 0, errors.New("invalid expire time")
+		}
+		n *= 1000
 	}
+	if opt == "EX" || opt == "PX" {
+		now := time.Now().UnixMilli()
+		if n > math.MaxInt64-now {
+			return 0, errors.New("invalid expire time")
+		}
+		n += now
+	}
+	return n, nil
+}
 
-	obj := Get(args[0])
+// ttlGeneric replies the remaining time to live of a key in
+// milliseconds, or seconds unless ms is set, -2 when the key does not
+// exist and -1 when it has no TTL
+func ttlGeneric(args []string, c *Client, ms bool) []byte {
+	obj := c.db.Get(args[0])
 	if obj == nil {
-		return Encode(errors.New("(error) Key doesn't exist"), false)
+		return RESP_MINUS_2
 	}
 
-	exp, isExpireSet := expires[obj]
+	exp, isExpireSet := c.db.getExpiry(obj)
 	if !isExpireSet {
 		return RESP_MINUS_1
 	}
 
-	if uint64(time.Now().UnixMilli()) > exp {
+	// Get deletes the expired keys, exp is in the future
+	durationMs := int64(exp) - time.Now().UnixMilli()
+	if durationMs < 0 {
+		durationMs = 0
+	}
+	if ms {
+		return Encode(durationMs, false)
+	}
+	return Encode((durationMs+500)/1000, false)
+}
+
+// TTL key
+func evalTTL(args []string, c *Client) []byte {
+	return ttlGeneric(args, c, false)
+}
+
+// PTTL key
+func evalPTTL(args []string, c *Client) []byte {
+	return ttlGeneric(args, c, true)
+}
+
+// expireTimeGeneric replies the absolute unix time at which a key
+// expires in milliseconds, or seconds unless ms is set, -2 when the key
+// does not exist and -1 when it has no TTL
+func expireTimeGeneric(args []string, c *Client, ms bool) []byte {
+	obj := c.db.Get(args[0])
+	if obj == nil {
 		return RESP_MINUS_2
 	}
-	durationMs := exp - uint64(time.Now().UnixMilli())
-	return []byte(fmt.Sprintf(":%d\r\n", int(math.Round(float64(durationMs/1000)))))
+
+	exp, isExpireSet := c.db.getExpiry(obj)
+	if !isExpireSet {
+		return RESP_MINUS_1
+	}
+	if ms {
+		return Encode(int64(exp), false)
+	}
+	return Encode(int64(exp/1000), false)
 }
 
-func evalDEL(args []string) []byte {
-	if len(args) == 0 {
-		return Encode(errors.New("(error) wrong number of arguments for DEL command"), false)
+// EXPIRETIME key
+func evalEXPIRETIME(args []string, c *Client) []byte {
+	return expireTimeGeneric(args, c, false)
+}
+
+// PEXPIRETIME key
+func evalPEXPIRETIME(args []string, c *Client) []byte {
+	return expireTimeGeneric(args, c, true)
+}
+
+// evalPERSIST removes the TTL of a key, it replies 1 when the key had one
+// PERSIST key
+func evalPERSIST(args []string, c *Client) []byte {
+	obj := c.db.Get(args[0])
+	if obj == nil || !c.db.persist(obj) {
+		return RESP_ZERO
 	}
+	return RESP_ONE
+}
 
+func evalDEL(args []string, c *Client) []byte {
 	var countDeleted int = 0
 
 	for _, key := range args {
-		if ok := Del(key); ok {
+		if ok := c.db.Del(key); ok {
 			countDeleted++
 		}
 	}
 	return Encode(countDeleted, false)
 }
 
-func evalEXPIRE(args []string) []byte {
-	if len(args) <= 1 {
-		return Encode(errors.New("(error) wrong number of arguments for EXPIRE command"), false)
+// evalEXISTS replies how many of the keys exist, a key given twice is
+// counted twice
+// EXISTS key [key ...]
+func evalEXISTS(args []string, c *Client) []byte {
+	count := 0
+	for _, key := range args {
+		if c.db.Get(key) != nil {
+			count++
+		}
 	}
+	return Encode(count, false)
+}
 
-	exDurationSec, err := strconv.ParseInt(args[1], 10, 64)
-	if err != nil {
-		return Encode(errors.New("(error) ERR value is not an integer or out of range"), false)
+// evalTYPE replies the type of the value of a key, none when it does not exist
+// TYPE key
+func evalTYPE(args []string, c *Client) []byte {
+	obj := c.db.Get(args[0])
+	if obj == nil {
+		return Encode("none", true)
 	}
+	return Encode(typeName(obj.TypeEncoding), true)
+}
 
-	obj := Get(args[0])
+// renameGeneric renames a key, keeping its TTL. It replies 0 when nx is
+// set and the new key exists.
+func renameGeneric(args []string, c *Client, nx bool) []byte {
+	obj := c.db.Get(args[0])
 	if obj == nil {
+		return Encode(errors.New("ERR no such key"), false)
+	}
+	if args[0] == args[1] {
+		if nx {
+			return RESP_ZERO
+		}
+		return RESP_OK
+	}
+	if nx && c.db.Get(args[1]) != nil {
 		return RESP_ZERO
 	}
 
-	SetExpiry(obj, exDurationSec*1000)
+	exp, hasExpiry := c.db.getExpiry(obj)
+	c.db.Del(args[0])
+	c.db.Put(args[1], obj)
+	if hasExpiry {
+		c.db.setExpireAt(obj, exp)
+	}
+	if nx {
+		return RESP_ONE
+	}
+	return RESP_OK
+}
 
-	return Encode(1, false)
+// RENAME key newkey
+func evalRENAME(args []string, c *Client) []byte {
+	return renameGeneric(args, c, false)
 }
 
-// TODO: make it asnyc by forking process
-func evalBGREWRITEAOF(args []string) []byte {
-	DumpAllAOF()
+// RENAMENX key newkey
+func evalRENAMENX(args []string, c *Client) []byte {
+	return renameGeneric(args, c, true)
+}
+
+// evalCOPY copies the value and the TTL of a key to another key, in the
+// same database or the one given with DB. It replies 0 when the
+// destination exists, unless REPLACE is given.
+// COPY source destination [DB destination-db] [REPLACE]
+func evalCOPY(args []string, c *Client) []byte {
+	dst := c.db
+	replace := false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 == len(args) {
+				return Encode(errors.New("ERR syntax error"), false)
+			}
+			i++
+			db, err := c.store.lookupDB(args[i])
+			if err != nil {
+				return Encode(err, false)
+			}
+			dst = db
+		default:
+			return Encode(errors.New("ERR syntax error"), false)
+		}
+	}
+	if dst == c.db && args[0] == args[1] {
+		return Encode(errors.New("ERR source and destination objects are the same"), false)
+	}
+
+	obj := c.db.Get(args[0])
+	if obj == nil {
+		return RESP_ZERO
+	}
+	if !replace && dst.Get(args[1]) != nil {
+		return RESP_ZERO
+	}
+
+	cp := NewObj(obj.Value, GetType(obj.TypeEncoding), GetEncoding(obj.TypeEncoding))
+	dst.Put(args[1], cp)
+	if exp, ok := c.db.getExpiry(obj); ok {
+		dst.setExpireAt(cp, exp)
+	}
+	return RESP_ONE
+}
+
+// evalTOUCH updates the last access time of the keys and replies how
+// many of them exist
+// TOUCH key [key ...]
+func evalTOUCH(args []string, c *Client) []byte {
+	// Get updates the access time
+	return evalEXISTS(args, c)
+}
+
+// evalRANDOMKEY replies a key of the database picked at random, nil when
+// it is empty. The expired keys met on the way are deleted.
+// RANDOMKEY
+func evalRANDOMKEY(args []string, c *Client) []byte {
+	for key, obj := range c.db.dict {
+		if c.db.HasExpired(obj) {
+			c.db.Del(key)
+			continue
+		}
+		return Encode(key, false)
+	}
+	return EncodeProto(nil, false, c.proto)
+}
+
+// evalKEYS replies the keys matching the glob-style pattern
+// KEYS pattern
+func evalKEYS(args []string, c *Client) []byte {
+	keys := make([]string, 0)
+	for key, obj := range c.db.dict {
+		if !c.db.HasExpired(obj) && globMatch(args[0], key) {
+			keys = append(keys, key)
+		}
+	}
+	return Encode(keys, false)
+}
+
+// evalSCAN replies a few keys of the database and the cursor to pass to
+// the next call, 0 once the iteration is complete. A key present from the
+// first call to the last one is replied at least once, a key may be
+// replied more than once.
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func evalSCAN(args []string, c *Client) []byte {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return Encode(errors.New("ERR invalid cursor"), false)
+	}
+
+	var pattern, typ string
+	count := int64(10)
+	for i := 1; i < len(args); i++ {
+		if i+1 == len(args) {
+			return Encode(errors.New("ERR syntax error"), false)
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.ParseInt(args[i+1], 10, 64); err != nil {
+				return Encode(errors.New("ERR value is not an integer or out of range"), false)
+			}
+			if count < 1 {
+				return Encode(errors.New("ERR syntax error"), false)
+			}
+		case "TYPE":
+			typ = strings.ToLower(args[i+1])
+		default:
+			return Encode(errors.New("ERR syntax error"), false)
+		}
+		i++
+	}
+
+	// COUNT is a hint, the buckets visited are bounded for the call to
+	// stay short when most of them are empty. Visiting more buckets than
+	// the index has would not return more keys.
+	maxIterations := int64(len(c.db.index.buckets))
+	if count <= maxIterations/10 {
+		maxIterations = count * 10
+	}
+	keys := make([]string, 0)
+	for ; maxIterations > 0; maxIterations-- {
+		cursor = c.db.index.scan(cursor, func(key string) {
+			keys = append(keys, key)
+		})
+		if cursor == 0 || int64(len(keys)) >= count {
+			break
+		}
+	}
+
+	// the filters apply once the buckets are visited, Get deletes the
+	// expired keys
+	matched := keys[:0]
+	for _, key := range keys {
+		obj := c.db.Get(key)
+		if obj == nil || (pattern != "" && !globMatch(pattern, key)) || (typ != "" && typeName(obj.TypeEncoding) != typ) {
+			continue
+		}
+		matched = append(matched, key)
+	}
+	return Encode([]interface{}{strconv.FormatUint(cursor, 10), matched}, false)
+}
+
+// lookupDB returns the database of s numbered index
+func (s *Store) lookupDB(index string) (*DB, error) {
+	id, err := strconv.Atoi(index)
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	if id < 0 || id >= len(s.dbs) {
+		return nil, errors.New("ERR DB index is out of range")
+	}
+	return s.dbs[id], nil
+}
+
+func evalSELECT(args []string, c *Client) []byte {
+	db, err := c.store.lookupDB(args[0])
+	if err != nil {
+		return Encode(err, false)
+	}
+	c.db = db
+	return RESP_OK
+}
+
+// evalMOVE moves a key, with its TTL, to another database. It replies 0
+// when the key does not exist or already exists in the target database.
+// MOVE key db
+func evalMOVE(args []string, c *Client) []byte {
+	dst, err := c.store.lookupDB(args[1])
+	if err != nil {
+		return Encode(err, false)
+	}
+	src := c.db
+	if src == dst {
+		return Encode(errors.New("ERR source and destination objects are the same"), false)
+	}
+
+	obj := src.Get(args[0])
+	if obj == nil || dst.Get(args[0]) != nil {
+		return RESP_ZERO
+	}
+
+	exp, hasExpiry := src.getExpiry(obj)
+	src.Del(args[0])
+	dst.Put(args[0], obj)
+	if hasExpiry {
+		dst.setExpireAt(obj, exp)
+	}
+	return RESP_ONE
+}
+
+// evalSWAPDB swaps the keys of two databases, the clients connected to
+// one of them see the keys of the other right away
+// SWAPDB index1 index2
+func evalSWAPDB(args []string, c *Client) []byte {
+	if _, err := strconv.Atoi(args[0]); err != nil {
+		return Encode(errors.New("ERR invalid first DB index"), false)
+	}
+	if _, err := strconv.Atoi(args[1]); err != nil {
+		return Encode(errors.New("ERR invalid second DB index"), false)
+	}
+	db1, err := c.store.lookupDB(args[0])
+	if err != nil {
+		return Encode(err, false)
+	}
+	db2, err := c.store.lookupDB(args[1])
+	if err != nil {
+		return Encode(err, false)
+	}
+
+	db1.swap(db2)
 	return RESP_OK
 }
 
-func evalINCR(args []string) []byte {
+// parseFlushMode validates the optional ASYNC or SYNC argument of the
+// flush commands, the keys are always freed synchronously
+func parseFlushMode(args []string) error {
 	if len(args) == 0 {
-		return Encode(errors.New("(error) wrong number of arguments for INCR command"), false)
+		return nil
+	}
+	if len(args) == 1 {
+		switch strings.ToUpper(args[0]) {
+		case "ASYNC", "SYNC":
+			return nil
+		}
+	}
+	return errors.New("ERR syntax error")
+}
+
+// FLUSHDB [ASYNC | SYNC]
+func evalFLUSHDB(args []string, c *Client) []byte {
+	if err := parseFlushMode(args); err != nil {
+		return Encode(err, false)
+	}
+	c.db.flush()
+	// an empty database is flushed in the AOF as well
+	c.store.dirty++
+	return RESP_OK
+}
+
+// FLUSHALL [ASYNC | SYNC]
+func evalFLUSHALL(args []string, c *Client) []byte {
+	if err := parseFlushMode(args); err != nil {
+		return Encode(err, false)
+	}
+	for _, db := range c.store.dbs {
+		db.flush()
+	}
+	c.store.dirty++
+	return RESP_OK
+}
+
+func evalDBSIZE(args []string, c *Client) []byte {
+	return Encode(len(c.db.dict), false)
+}
+
+// expireGeneric sets the expiry of a key for the EXPIRE family. name is
+// the command, the time is in seconds unless ms is set and relative to
+// now unless absolute is set. It replies 1 when the expiry was set and 0
+// when the key does not exist or a condition flag was not met.
+// <name> key time [NX | XX | GT | LT]
+func expireGeneric(args []string, c *Client, name string, ms bool, absolute bool) []byte {
+	when, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return Encode(errors.New("ERR value is not an integer or out of range"), false)
+	}
+
+	var nx, xx, gt, lt bool
+	for _, arg := range args[2:] {
+		switch strings.ToUpper(arg) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			return Encode(fmt.Errorf("ERR Unsupported option %s", arg), false)
+		}
+	}
+	if nx && (xx || gt || lt) {
+		return Encode(errors.New("ERR NX and XX, GT or LT options at the same time are not compatible"), false)
+	}
+	if gt && lt {
+		return Encode(errors.New("ERR GT and LT options at the same time are not compatible"), false)
 	}
 
-	obj := Get(args[0])
+	invalid := Encode(fmt.Errorf("ERR invalid expire time in '%s' command", name), false)
+	if !ms {
+		if when > math.MaxInt64/1000 || when < math.MinInt64/1000 {
+			return invalid
+		}
+		when *= 1000
+	}
+	if !absolute {
+		now := time.Now().UnixMilli()
+		if when > math.MaxInt64-now {
+			return invalid
+		}
+		when += now
+	}
+
+	obj := c.db.Get(args[0])
+	if obj == nil {
+		return RESP_ZERO
+	}
+
+	// a key without a TTL never expires, it is greater than any expiry
+	exp, hasExpiry := c.db.getExpiry(obj)
+	switch {
+	case nx && hasExpiry,
+		xx && !hasExpiry,
+		gt && (!hasExpiry || when <= int64(exp)),
+		lt && hasExpiry && when >= int64(exp):
+		return RESP_ZERO
+	}
+
+	// an expiry in the past deletes the key right away
+	if when <= time.Now().UnixMilli() {
+		c.db.Del(args[0])
+		propagateAs(c, []string{"DEL", args[0]})
+		return RESP_ONE
+	}
+
+	c.db.setExpireAt(obj, uint64(when))
+	propagateAs(c, []string{"PEXPIREAT", args[0], strconv.FormatInt(when, 10)})
+	return RESP_ONE
+}
+
+// EXPIRE key seconds [NX | XX | GT | LT]
+func evalEXPIRE(args []string, c *Client) []byte {
+	return expireGeneric(args, c, "expire", false, false)
+}
+
+// PEXPIRE key milliseconds [NX | XX | GT | LT]
+func evalPEXPIRE(args []string, c *Client) []byte {
+	return expireGeneric(args, c, "pexpire", true, false)
+}
+
+// EXPIREAT key unix-time-seconds [NX | XX | GT | LT]
+func evalEXPIREAT(args []string, c *Client) []byte {
+	return expireGeneric(args, c, "expireat", false, true)
+}
+
+// PEXPIREAT key unix-time-milliseconds [NX | XX | GT | LT]
+func evalPEXPIREAT(args []string, c *Client) []byte {
+	return expireGeneric(args, c, "pexpireat", true, true)
+}
+
+func evalLRU(args []string, c *Client) []byte {
+	c.store.Evict()
+	return RESP_OK
+}
+
+func evalBGREWRITEAOF(args []string, c *Client) []byte {
+	s := c.store
+	if s.rdb.inProgress && !s.aof.rewrite.inProgress {
+		s.aof.rewriteScheduled = true
+		return Encode("Background append only file rewriting scheduled", true)
+	}
+	if err := s.rewriteAppendOnlyFileBackground(); err != nil {
+		return Encode(err, false)
+	}
+	return Encode("Background append only file rewriting started", true)
+}
+
+func evalSAVE(args []string, c *Client) []byte {
+	if err := c.store.rdbSaveSync(); err != nil {
+		if strings.HasPrefix(err.Error(), "ERR") {
+			return Encode(err, false)
+		}
+		return Encode(errors.New("ERR "+err.Error()), false)
+	}
+	return RESP_OK
+}
+
+// evalBGSAVE saves the snapshot in the background
+// BGSAVE [SCHEDULE]
+func evalBGSAVE(args []string, c *Client) []byte {
+	schedule := false
+	if len(args) > 0 {
+		if len(args) > 1 || strings.ToUpper(args[0]) != "SCHEDULE" {
+			return Encode(errors.New("ERR syntax error"), false)
+		}
+		schedule = true
+	}
+
+	s := c.store
+	if schedule && s.aof.rewrite.inProgress && !s.rdb.inProgress {
+		s.rdb.saveScheduled = true
+		return Encode("Background saving scheduled", true)
+	}
+	if err := s.rdbSaveBackground(); err != nil {
+		return Encode(err, false)
+	}
+	return Encode("Background saving started", true)
+}
+
+func evalLASTSAVE(args []string, c *Client) []byte {
+	return Encode(c.store.rdb.lastSave.Unix(), false)
+}
+
+// incrDecrGeneric adds delta to the integer stored at a key, 0 when the
+// key does not exist, and replies the new value
+func incrDecrGeneric(c *Client, key string, delta int64) []byte {
+	obj := c.db.Get(key)
+	var value int64
+	if obj != nil {
+		if err := AssertType(obj.TypeEncoding, OBJ_TYPE_STRING); err != nil {
+			return Encode(err, false)
+		}
+		if GetEncoding(obj.TypeEncoding) != OBJ_ENCODING_INT {
+			return Encode(errors.New("ERR value is not an integer or out of range"), false)
+		}
+		value = obj.Value.(int64)
+	}
+
+	if (delta < 0 && value < math.MinInt64-delta) || (delta > 0 && value > math.MaxInt64-delta) {
+		return Encode(errors.New("ERR increment or decrement would overflow"), false)
+	}
+	value += delta
+
+	if obj == nil {
+		c.db.Put(key, NewObj(value, OBJ_TYPE_STRING, OBJ_ENCODING_INT))
+	} else {
+		obj.Value = value
+		c.store.dirty++
+	}
+	return Encode(value, false)
+}
+
+// INCR key
+func evalINCR(args []string, c *Client) []byte {
+	return incrDecrGeneric(c, args[0], 1)
+}
+
+// DECR key
+func evalDECR(args []string, c *Client) []byte {
+	return incrDecrGeneric(c, args[0], -1)
+}
+
+// INCRBY key increment
+func evalINCRBY(args []string, c *Client) []byte {
+	delta, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return Encode(errors.New("ERR value is not an integer or out of range"), false)
+	}
+	return incrDecrGeneric(c, args[0], delta)
+}
+
+// DECRBY key decrement
+func evalDECRBY(args []string, c *Client) []byte {
+	delta, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return Encode(errors.New("ERR value is not an integer or out of range"), false)
+	}
+	if delta == math.MinInt64 {
+		return Encode(errors.New("ERR decrement would overflow"), false)
+	}
+	return incrDecrGeneric(c, args[0], -delta)
+}
+
+// parseFloat parses a float argument or value, NaN is not a number
+func parseFloat(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || strings.TrimSpace(s) != s {
+		return 0, false
+	}
+	return f, true
+}
+
+// evalINCRBYFLOAT adds a float to the number stored at a key, 0 when the
+// key does not exist, and replies the new value. It is logged as a SET of
+// the result so that a reload does not accumulate rounding errors.
+// INCRBYFLOAT key increment
+func evalINCRBYFLOAT(args []string, c *Client) []byte {
+	incr, ok := parseFloat(args[1])
+	if !ok {
+		return Encode(errors.New("ERR value is not a valid float"), false)
+	}
+
+	obj := c.db.Get(args[0])
+	var value float64
+	if obj != nil {
+		if err := AssertType(obj.TypeEncoding, OBJ_TYPE_STRING); err != nil {
+			return Encode(err, false)
+		}
+		if value, ok = parseFloat(getString(obj)); !ok {
+			return Encode(errors.New("ERR value is not a valid float"), false)
+		}
+	}
+
+	value += incr
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return Encode(errors.New("ERR increment would produce NaN or Infinity"), false)
+	}
+
+	result := strconv.FormatFloat(value, 'f', -1, 64)
+	setKey(c, args[0], result, 0, true)
+	propagateAs(c, []string{"SET", args[0], result, "KEEPTTL"})
+	return Encode(result, false)
+}
+
+// evalMGET replies the strings of the keys, nil for the missing ones
+// MGET key [key ...]
+func evalMGET(args []string, c *Client) []byte {
+	values := make([]interface{}, len(args))
+	for i, key := range args {
+		if obj := c.db.Get(key); obj != nil {
+			values[i] = getString(obj)
+		}
+	}
+	return EncodeProto(values, false, c.proto)
+}
+
+// msetGeneric sets the keys of args, alternating keys and values, after
+// making room for the ones that do not exist yet
+func msetGeneric(args []string, c *Client) error {
+	newKeys := make(map[string]bool)
+	for i := 0; i < len(args); i += 2 {
+		if c.db.Get(args[i]) == nil {
+			newKeys[args[i]] = true
+		}
+	}
+	if err := c.store.reserveKeys(len(newKeys)); err != nil {
+		return err
+	}
+	for i := 0; i < len(args); i += 2 {
+		c.db.Put(args[i], newStringObj(args[i+1]))
+	}
+	return nil
+}
+
+// MSET key value [key value ...]
+func evalMSET(args []string, c *Client) []byte {
+	if len(args)%2 != 0 {
+		return Encode(errors.New("ERR wrong number of arguments for 'mset' command"), false)
+	}
+	if err := msetGeneric(args, c); err != nil {
+		return Encode(err, false)
+	}
+	return RESP_OK
+}
+
+// evalMSETNX sets the keys only when none of them exists, it replies 1
+// when they were set
+// MSETNX key value [key value ...]
+func evalMSETNX(args []string, c *Client) []byte {
+	if len(args)%2 != 0 {
+		return Encode(errors.New("ERR wrong number of arguments for 'msetnx' command"), false)
+	}
+	for i := 0; i < len(args); i += 2 {
+		if c.db.Get(args[i]) != nil {
+			return RESP_ZERO
+		}
+	}
+	if err := msetGeneric(args, c); err != nil {
+		return Encode(err, false)
+	}
+	return RESP_ONE
+}
+
+// checkStringLength returns an error when adding add bytes to a string of
+// size bytes would make it larger than the largest bulk string a client
+// can send. It subtracts rather than adds, size can be any offset.
+func checkStringLength(c *Client, size, add int64) error {
+	if size > int64(c.store.config.ProtoMaxBulkLen)-add {
+		return errors.New("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+	}
+	return nil
+}
+
+// evalAPPEND appends value to the string of a key, creating it when it
+// does not exist, and replies the new length
+// APPEND key value
+func evalAPPEND(args []string, c *Client) []byte {
+	obj := c.db.Get(args[0])
 	if obj == nil {
-		obj = NewObj("0", -1, OBJ_TYPE_STRING, OBJ_ENCODING_INT)
-		Put(args[0], obj)
+		setKey(c, args[0], args[1], 0, false)
+		propagateAs(c, append([]string{"APPEND"}, args...))
+		return Encode(len(args[1]), false)
 	}
 
-	if err := AssertType(obj.TypeEncoding, OBJ_TYPE_STRING); err != nil {
+	old := getString(obj)
+	if err := checkStringLength(c, int64(len(old)), int64(len(args[1]))); err != nil {
 		return Encode(err, false)
 	}
+	c.db.setString(obj, old+args[1])
+	return Encode(len(old)+len(args[1]), false)
+}
+
+// STRLEN key
+func evalSTRLEN(args []string, c *Client) []byte {
+	obj := c.db.Get(args[0])
+	if obj == nil {
+		return RESP_ZERO
+	}
+	return Encode(len(getString(obj)), false)
+}
+
+// evalGETRANGE replies the substring of the string of a key between the
+// offsets start and end, both included, negative offsets count from the end
+// GETRANGE key start end
+func evalGETRANGE(args []string, c *Client) []byte {
+	start, err1 := strconv.ParseInt(args[1], 10, 64)
+	end, err2 := strconv.ParseInt(args[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return Encode(errors.New("ERR value is not an integer or out of range"), false)
+	}
+
+	obj := c.db.Get(args[0])
+	if obj == nil {
+		return Encode("", false)
+	}
+	value := getString(obj)
+	size := int64(len(value))
+
+	if start < 0 && end < 0 && start > end {
+		return Encode("", false)
+	}
+	if start < 0 {
+		start += size
+	}
+	if end < 0 {
+		end += size
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= size {
+		end = size - 1
+	}
+	if start > end || size == 0 {
+		return Encode("", false)
+	}
+	return Encode(value[start:end+1], false)
+}
+
+// evalSETRANGE overwrites the string of a key from offset with value,
+// padding it with zero bytes when it is shorter than offset, and replies
+// the new length
+// SETRANGE key offset value
+func evalSETRANGE(args []string, c *Client) []byte {
+	offset, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return Encode(errors.New("ERR value is not an integer or out of range"), false)
+	}
+	if offset < 0 {
+		return Encode(errors.New("ERR offset is out of range"), false)
+	}
 
-	if err := AssertEncoding(obj.TypeEncoding, OBJ_ENCODING_INT); err != nil {
+	value := args[2]
+	obj := c.db.Get(args[0])
+	var old string
+	if obj != nil {
+		old = getString(obj)
+	}
+	// nothing is written, an empty value does not create the key
+	if len(value) == 0 {
+		return Encode(len(old), false)
+	}
+	if err := checkStringLength(c, offset, int64(len(value))); err != nil {
 		return Encode(err, false)
 	}
 
-	i, _ := strconv.ParseInt(obj.Value.(string), 10, 64)
-	i++
-	obj.Value = strconv.FormatInt(i, 10)
+	buf := []byte(old)
+	if end := int(offset) + len(value); end > len(buf) {
+		buf = append(buf, make([]byte, end-len(buf))...)
+	}
+	copy(buf[offset:], value)
+
+	if obj == nil {
+		setKey(c, args[0], string(buf), 0, false)
+		propagateAs(c, append([]string{"SETRANGE"}, args...))
+	} else {
+		c.db.setString(obj, string(buf))
+	}
+	return Encode(len(buf), false)
+}
+
+// evalGETDEL replies the string of a key and deletes the key
+// GETDEL key
+func evalGETDEL(args []string, c *Client) []byte {
+	obj := c.db.Get(args[0])
+	if obj == nil {
+		return EncodeProto(nil, false, c.proto)
+	}
+	c.db.Del(args[0])
+	propagateAs(c, []string{"DEL", args[0]})
+	return Encode(getString(obj), false)
+}
+
+// evalGETEX replies the string of a key and sets or removes its TTL
+// GETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds |
+// PXAT unix-time-milliseconds | PERSIST]
+func evalGETEX(args []string, c *Client) []byte {
+	var persist bool
+	var expiry string
+	var expireAt int64
+	for i := 1; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "PERSIST":
+			if expiry != "" || persist {
+				return Encode(errors.New("ERR syntax error"), false)
+			}
+			persist = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if expiry != "" || persist || i+1 == len(args) {
+				return Encode(errors.New("ERR syntax error"), false)
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return Encode(errors.New("ERR value is not an integer or out of range"), false)
+			}
+			if expireAt, err = parseExpireAt(opt, n); err != nil {
+				return Encode(fmt.Errorf("ERR invalid expire time in '%s' command", "getex"), false)
+			}
+			expiry = opt
+		default:
+			return Encode(errors.New("ERR syntax error"), false)
+		}
+	}
+
+	obj := c.db.Get(args[0])
+	if obj == nil {
+		return EncodeProto(nil, false, c.proto)
+	}
+	reply := Encode(getString(obj), false)
+
+	switch {
+	case expiry != "" && expireAt <= time.Now().UnixMilli():
+		// an expiry in the past deletes the key right away
+		c.db.Del(args[0])
+		propagateAs(c, []string{"DEL", args[0]})
+	case expiry != "":
+		c.db.setExpireAt(obj, uint64(expireAt))
+		propagateAs(c, []string{"PEXPIREAT", args[0], strconv.FormatInt(expireAt, 10)})
+	case persist:
+		if c.db.persist(obj) {
+			propagateAs(c, []string{"PERSIST", args[0]})
+		}
+	}
+	return reply
+}
+
+// evalSETNX sets a key only when it does not exist, it replies 1 when
+// the key was set
+// SETNX key value
+func evalSETNX(args []string, c *Client) []byte {
+	if c.db.Get(args[0]) != nil {
+		return RESP_ZERO
+	}
+	setKey(c, args[0], args[1], 0, false)
+	return RESP_ONE
+}
+
+// setExGeneric sets a key expiring after a TTL for SETEX, in seconds,
+// and PSETEX, in milliseconds
+func setExGeneric(args []string, c *Client, name string, unit string) []byte {
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return Encode(errors.New("ERR value is not an integer or out of range"), false)
+	}
+	expireAt, err := parseExpireAt(unit, n)
+	if err != nil {
+		return Encode(fmt.Errorf("ERR invalid expire time in '%s' command", name), false)
+	}
+	setKey(c, args[0], args[2], expireAt, false)
+	return RESP_OK
+}
+
+// SETEX key seconds value
+func evalSETEX(args []string, c *Client) []byte {
+	return setExGeneric(args, c, "setex", "EX")
+}
+
+// PSETEX key milliseconds value
+func evalPSETEX(args []string, c *Client) []byte {
+	return setExGeneric(args, c, "psetex", "PX")
+}
+
+// evalLCS replies the longest common subsequence of the strings of two
+// keys, its length with LEN or the ranges of the matches with IDX
+// LCS key1 key2 [LEN] [IDX] [MINMATCHLEN min-match-len] [WITHMATCHLEN]
+func evalLCS(args []string, c *Client) []byte {
+	var getLen, getIdx, withMatchLen bool
+	var minMatchLen int64
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "LEN":
+			getLen = true
+		case "IDX":
+			getIdx = true
+		case "WITHMATCHLEN":
+			withMatchLen = true
+		case "MINMATCHLEN":
+			if i+1 == len(args) {
+				return Encode(errors.New("ERR syntax error"), false)
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return Encode(errors.New("ERR value is not an integer or out of range"), false)
+			}
+			if n > 0 {
+				minMatchLen = n
+			}
+		default:
+			return Encode(errors.New("ERR syntax error"), false)
+		}
+	}
+	if getLen && getIdx {
+		return Encode(errors.New("ERR If you want both the length and indexes, please just use IDX."), false)
+	}
+
+	// a missing key is an empty string
+	var a, b string
+	if obj := c.db.Get(args[0]); obj != nil {
+		a = getString(obj)
+	}
+	if obj := c.db.Get(args[1]); obj != nil {
+		b = getString(obj)
+	}
+	if uint64(len(a)+1)*uint64(len(b)+1) >= math.MaxUint32/4 {
+		return Encode(errors.New("ERR String too long for LCS"), false)
+	}
+
+	// dp[i*(len(b)+1)+j] is the length of the LCS of a[:i] and b[:j]
+	width := len(b) + 1
+	dp := make([]uint32, (len(a)+1)*width)
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			switch {
+			case a[i-1] == b[j-1]:
+				dp[i*width+j] = dp[(i-1)*width+j-1] + 1
+			case dp[(i-1)*width+j] > dp[i*width+j-1]:
+				dp[i*width+j] = dp[(i-1)*width+j]
+			default:
+				dp[i*width+j] = dp[i*width+j-1]
+			}
+		}
+	}
+	lcsLen := dp[len(a)*width+len(b)]
+	if getLen {
+		return Encode(int64(lcsLen), false)
+	}
+
+	// walk the table back from the end, collecting the LCS and the ranges
+	// of contiguous matches, from the last one to the first one
+	lcs := make([]byte, lcsLen)
+	idx := lcsLen
+	matches := make([]interface{}, 0)
+	inRange := false
+	var aStart, aEnd, bStart, bEnd int
+	for i, j := len(a), len(b); i > 0 && j > 0; {
+		emit := false
+		if a[i-1] == b[j-1] {
+			lcs[idx-1] = a[i-1]
+			idx--
+			if !inRange {
+				inRange = true
+				aStart, aEnd, bStart, bEnd = i-1, i-1, j-1, j-1
+			} else {
+				// the range is contiguous, it grows backward
+				aStart--
+				bStart--
+			}
+			// the first byte of a string ends the walk
+			emit = aStart == 0 || bStart == 0
+			i--
+			j--
+		} else {
+			if dp[(i-1)*width+j] > dp[i*width+j-1] {
+				i--
+			} else {
+				j--
+			}
+			emit = inRange
+		}
+
+		if emit {
+			matchLen := aEnd - aStart + 1
+			if int64(matchLen) >= minMatchLen {
+				match := []interface{}{
+					[]interface{}{aStart, aEnd},
+					[]interface{}{bStart, bEnd},
+				}
+				if withMatchLen {
+					match = append(match, matchLen)
+				}
+				matches = append(matches, match)
+			}
+			inRange = false
+		}
+	}
 
-	return Encode(i, false)
+	if getIdx {
+		return EncodeProto(Map{
+			{"matches", matches},
+			{"len", int64(lcsLen)},
+		}, false, c.proto)
+	}
+	return Encode(string(lcs), false)
 }
 
-func evalINFO(args []string) []byte {
+// evalINFO replies the requested sections, all of them by default
+// INFO [section ...]
+func evalINFO(args []string, c *Client) []byte {
+	sections := map[string]bool{}
+	for _, arg := range args {
+		sections[strings.ToLower(arg)] = true
+	}
+	all := len(args) == 0 || sections["all"] || sections["everything"] || sections["default"]
+
 	var info []byte
 	buf := bytes.NewBuffer(info)
-	buf.WriteString("# Keyspace\r\n")
-	for i := range KeyspaceStat {
-		buf.WriteString(fmt.Sprintf("db%d:keys=%d,expires=0,avg_ttl=0\r\n", i, KeyspaceStat[i]["keys"]))
+	if all || sections["persistence"] {
+		c.store.writeInfoPersistence(buf)
+	}
+	if all || sections["keyspace"] {
+		if buf.Len() > 0 {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString("# Keyspace\r\n")
+		for _, db := range c.store.dbs {
+			if stat := db.Stat(); stat.Keys > 0 {
+				buf.WriteString(fmt.Sprintf("db%d:keys=%d,expires=%d,avg_ttl=%d\r\n", db.ID, stat.Keys, stat.Expires, stat.AvgTTL))
+			}
+		}
 	}
 	return Encode(buf.String(), false)
 }
 
-func evalCLIENT(args []string) []byte {
-	return RESP_OK
+func (s *Store) writeInfoPersistence(buf *bytes.Buffer) {
+	boolToInt := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	currentRewriteSec := int64(-1)
+	if s.aof.rewrite.inProgress {
+		currentRewriteSec = int64(time.Since(s.aof.rewrite.start).Seconds())
+	}
+	currentBgsaveSec := int64(-1)
+	if s.rdb.inProgress {
+		currentBgsaveSec = int64(time.Since(s.rdb.start).Seconds())
+	}
+
+	buf.WriteString("# Persistence\r\n")
+	buf.WriteString(fmt.Sprintf("loading:%d\r\n", boolToInt(s.loading)))
+	buf.WriteString(fmt.Sprintf("rdb_changes_since_last_save:%d\r\n", s.dirty-s.rdb.dirtyAtLastSave))
+	buf.WriteString(fmt.Sprintf("rdb_bgsave_in_progress:%d\r\n", boolToInt(s.rdb.inProgress)))
+	buf.WriteString(fmt.Sprintf("rdb_last_save_time:%d\r\n", s.rdb.lastSave.Unix()))
+	buf.WriteString(fmt.Sprintf("rdb_last_bgsave_status:%s\r\n", s.rdb.lastStatus))
+	buf.WriteString(fmt.Sprintf("rdb_last_bgsave_time_sec:%d\r\n", durationToSec(s.rdb.lastDuration)))
+	buf.WriteString(fmt.Sprintf("rdb_current_bgsave_time_sec:%d\r\n", currentBgsaveSec))
+	buf.WriteString(fmt.Sprintf("aof_enabled:%d\r\n", boolToInt(s.aof.file != nil)))
+	buf.WriteString(fmt.Sprintf("aof_rewrite_in_progress:%d\r\n", boolToInt(s.aof.rewrite.inProgress)))
+	buf.WriteString(fmt.Sprintf("aof_rewrite_scheduled:%d\r\n", boolToInt(s.aof.rewriteScheduled)))
+	buf.WriteString(fmt.Sprintf("aof_last_rewrite_time_sec:%d\r\n", durationToSec(s.aof.rewrite.lastDuration)))
+	buf.WriteString(fmt.Sprintf("aof_current_rewrite_time_sec:%d\r\n", currentRewriteSec))
+	buf.WriteString(fmt.Sprintf("aof_last_bgrewrite_status:%s\r\n", s.aof.rewrite.lastStatus))
+	buf.WriteString(fmt.Sprintf("aof_last_write_status:%s\r\n", s.aof.lastWriteStatus))
+	if s.aof.file != nil {
+		buf.WriteString(fmt.Sprintf("aof_current_size:%d\r\n", s.aof.currentSize))
+		buf.WriteString(fmt.Sprintf("aof_base_size:%d\r\n", s.aof.baseSize))
+		buf.WriteString(fmt.Sprintf("aof_buffer_length:%d\r\n", len(s.aof.buf)))
+		buf.WriteString(fmt.Sprintf("aof_rewrite_buffer_length:%d\r\n", len(s.aof.rewrite.buf)))
+	}
 }
 
-func evalLATENCY(args []string) []byte {
-	return Encode([]string{}, false)
+// durationToSec returns d in seconds, -1 when d is negative
+func durationToSec(d time.Duration) int64 {
+	if d < 0 {
+		return -1
+	}
+	return int64(d.Seconds())
 }
 
-func evalMulti(args []string) []byte {
+func evalCLIENT(args []string, c *Client) []byte {
 	return RESP_OK
 }
+
+func evalLATENCY(args []string, c *Client) []byte {
+	return Encode([]string{}, false)
+}
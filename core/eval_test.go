@@ -0,0 +1,612 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestStore returns an empty store persisting to a temporary directory
+func newTestStore(t *testing.T) *Store {
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.AOFFile = filepath.Join(dir, "test.aof")
+	cfg.RDBFile = filepath.Join(dir, "test.rdb")
+	cfg.Save = ""
+	s, err := NewStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+// run executes the command line on c and returns the raw reply
+func run(c *Client, line string) string {
+	tokens := strings.Fields(line)
+	return string(executeCommand(&RedisCmd{Cmd: tokens[0], Args: tokens[1:]}, c))
+}
+
+func TestCommandLookup(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	c := s.NewClient(-1)
+	cases := map[string]string{
+		"ping":       "+PONG\r\n",
+		"PiNg hello": "$5\r\nhello\r\n",
+		"GTE foo":    "-ERR unknown command 'GTE', with args beginning with: 'foo' \r\n",
+		"get":        "-ERR wrong number of arguments for 'get' command\r\n",
+		"set k":      "-ERR wrong number of arguments for 'set' command\r\n",
+		"expire k":   "-ERR wrong number of arguments for 'expire' command\r\n",
+	}
+	for line, expected := range cases {
+		if actual := run(c, line); actual != expected {
+			t.Errorf("%s: actual %q and expected %q mismatch", line, actual, expected)
+		}
+	}
+}
+
+func TestGETMissingKey(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	c := s.NewClient(-1)
+
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		{"GET k", "$-1\r\n"},
+		{"SET k nil", "+OK\r\n"},
+		{"GET k", "$3\r\nnil\r\n"},
+		{"PEXPIREAT k 1", ":1\r\n"},
+		{"GET k", "$-1\r\n"},
+	} {
+		if actual := run(c, tc.line); actual != tc.expected {
+			t.Fatalf("%s: actual %q and expected %q mismatch", tc.line, actual, tc.expected)
+		}
+	}
+
+	// a RESP3 client gets the null of its protocol from every command
+	c.proto = RESP3
+	for _, line := range []string{"GET k", "SET k v GET", "SET k v NX", "GETDEL missing", "GETEX missing"} {
+		if actual := run(c, line); actual != "_\r\n" {
+			t.Fatalf("%s: actual %q and expected a RESP3 null", line, actual)
+		}
+	}
+	run(c, "SELECT 1")
+	if actual := run(c, "RANDOMKEY"); actual != "_\r\n" {
+		t.Fatalf("RANDOMKEY: actual %q and expected a RESP3 null", actual)
+	}
+}
+
+func TestTransactionAbortsOnUnknownCommand(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	c := s.NewClient(-1)
+	var replies []string
+	for _, line := range []string{"MULTI", "SET txn-key v", "NOPE", "EXEC"} {
+		tokens := strings.Fields(line)
+		replies = append(replies, string(processCommand(&RedisCmd{Cmd: tokens[0], Args: tokens[1:]}, c)))
+	}
+	if !strings.HasPrefix(replies[3], "-EXECABORT") {
+		t.Fatalf("expected EXECABORT got %q", replies[3])
+	}
+	if obj := s.dbs[0].Get("txn-key"); obj != nil {
+		t.Fatalf("queued command ran after the transaction was aborted")
+	}
+}
+
+func TestCommandIntrospection(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	c := s.NewClient(-1)
+	cases := map[string]string{
+		"COMMAND GETKEYS del a b c":  "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n",
+		"COMMAND GETKEYS set k v EX": "*1\r\n$1\r\nk\r\n",
+		"COMMAND GETKEYS ping":       "-ERR The command has no key arguments\r\n",
+		"COMMAND GETKEYS nope k":     "-ERR Invalid command specified\r\n",
+		"COMMAND GETKEYS get":        "-ERR Invalid number of arguments specified for command\r\n",
+		"COMMAND INFO nope":          "*1\r\n$-1\r\n",
+		"COMMAND DOCS nope":          "*0\r\n",
+		"COMMAND INFO get":           "*1\r\n*10\r\n$3\r\nget\r\n:2\r\n*2\r\n$8\r\nreadonly\r\n$4\r\nfast\r\n:1\r\n:1\r\n:1\r\n",
+		"COMMAND DOCS ping":          "*2\r\n$4\r\nping\r\n*8\r\n$7\r\nsummary\r\n",
+	}
+	for line, expected := range cases {
+		if actual := run(c, line); !strings.HasPrefix(actual, expected) {
+			t.Errorf("%s: actual %q does not start with %q", line, actual, expected)
+		}
+	}
+
+	if actual, expected := run(c, "COMMAND COUNT"), string(Encode(len(commandTable), false)); actual != expected {
+		t.Errorf("COMMAND COUNT: actual %q and expected %q mismatch", actual, expected)
+	}
+}
+
+func TestMultipleDatabases(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	c := s.NewClient(-1)
+	other := s.NewClient(-1)
+
+	for _, tc := range []struct {
+		client   *Client
+		line     string
+		expected string
+	}{
+		{c, "SELECT 16", "-ERR DB index is out of range\r\n"},
+		{c, "SELECT x", "-ERR value is not an integer or out of range\r\n"},
+		{c, "SET k0 a", "+OK\r\n"},
+		{c, "SELECT 1", "+OK\r\n"},
+		{c, "GET k0", "$-1\r\n"},
+		{c, "SET k1 b EX 100", "+OK\r\n"},
+		{c, "DBSIZE", ":1\r\n"},
+		{c, "MOVE k1 1", "-ERR source and destination objects are the same\r\n"},
+		{c, "MOVE k1 0", ":1\r\n"},
+		{c, "MOVE k1 0", ":0\r\n"},
+		{c, "DBSIZE", ":0\r\n"},
+		{other, "DBSIZE", ":2\r\n"},
+		{other, "SWAPDB 0 1", "+OK\r\n"},
+		{other, "SWAPDB 0 x", "-ERR invalid second DB index\r\n"},
+		{other, "DBSIZE", ":0\r\n"},
+		{c, "GET k0", "$1\r\na\r\n"},
+		{c, "FLUSHDB", "+OK\r\n"},
+		{c, "DBSIZE", ":0\r\n"},
+		{other, "SET k2 c", "+OK\r\n"},
+		{other, "FLUSHALL SYNC", "+OK\r\n"},
+		{other, "DBSIZE", ":0\r\n"},
+	} {
+		if actual := run(tc.client, tc.line); actual != tc.expected {
+			t.Fatalf("%s: actual %q and expected %q mismatch", tc.line, actual, tc.expected)
+		}
+	}
+
+	run(c, "SET k1 b EX 100")
+	info := run(c, "INFO keyspace")
+	if !strings.Contains(info, "db1:keys=1,expires=1,avg_ttl=") || strings.Contains(info, "db0:") {
+		t.Fatalf("unexpected keyspace info %q", info)
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	c := s.NewClient(-1)
+
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		{"SET k v NX XX", "-ERR syntax error\r\n"},
+		{"SET k v EX 10 PX 100", "-ERR syntax error\r\n"},
+		{"SET k v EX 10 KEEPTTL", "-ERR syntax error\r\n"},
+		{"SET k v EX", "-ERR syntax error\r\n"},
+		{"SET k v NOPE", "-ERR syntax error\r\n"},
+		{"SET k v EX x", "-ERR value is not an integer or out of range\r\n"},
+		{"SET k v EX 0", "-ERR invalid expire time in 'set' command\r\n"},
+		{"SET k v PX -1", "-ERR invalid expire time in 'set' command\r\n"},
+		{"SET k v EX 9223372036854775807", "-ERR invalid expire time in 'set' command\r\n"},
+		{"SET k v XX", "$-1\r\n"},
+		{"GET k", "$-1\r\n"},
+		{"SET k v1 nx px 100000", "+OK\r\n"},
+		{"SET k v2 NX", "$-1\r\n"},
+		{"SET k v2 NX GET", "$2\r\nv1\r\n"},
+		{"SET k v3 XX GET KEEPTTL", "$2\r\nv1\r\n"},
+		{"TTL k", ":<ttl>\r\n"},
+		{"SET k v4 GET", "$2\r\nv3\r\n"},
+		{"TTL k", ":-1\r\n"},
+		{"SET missing v GET", "$-1\r\n"},
+		{"SET k v EXAT 1", "+OK\r\n"},
+		{"GET k", "$-1\r\n"},
+	} {
+		actual := run(c, tc.line)
+		// a TTL in seconds drops under its initial value as time passes
+		if tc.expected == ":<ttl>\r\n" && (actual == ":99\r\n" || actual == ":100\r\n") {
+			continue
+		}
+		if actual != tc.expected {
+			t.Fatalf("%s: actual %q and expected %q mismatch", tc.line, actual, tc.expected)
+		}
+	}
+
+	// the TTL of the replaced value is dropped with it
+	run(c, "SET ttl-k v PXAT 9999999999999")
+	old := s.dbs[0].Get("ttl-k")
+	run(c, "SET ttl-k v")
+	if _, ok := s.dbs[0].expires[old]; ok || len(s.dbs[0].expires) != 0 {
+		t.Fatalf("the TTL of the replaced value leaked")
+	}
+}
+
+func TestExpireCommands(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	c := s.NewClient(-1)
+
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		{"TTL k", ":-2\r\n"},
+		{"PTTL k", ":-2\r\n"},
+		{"EXPIRETIME k", ":-2\r\n"},
+		{"PERSIST k", ":0\r\n"},
+		{"EXPIRE k 100", ":0\r\n"},
+		{"SET k v", "+OK\r\n"},
+		{"TTL k", ":-1\r\n"},
+		{"PEXPIRETIME k", ":-1\r\n"},
+		{"EXPIRE k 100 NX XX", "-ERR NX and XX, GT or LT options at the same time are not compatible\r\n"},
+		{"EXPIRE k 100 GT LT", "-ERR GT and LT options at the same time are not compatible\r\n"},
+		{"EXPIRE k 100 NOPE", "-ERR Unsupported option NOPE\r\n"},
+		{"EXPIRE k x", "-ERR value is not an integer or out of range\r\n"},
+		{"EXPIRE k 9223372036854775807", "-ERR invalid expire time in 'expire' command\r\n"},
+		{"EXPIRE k 100 XX", ":0\r\n"},
+		{"EXPIRE k 100 GT", ":0\r\n"},
+		{"EXPIREAT k 9999999999 LT", ":1\r\n"},
+		{"EXPIRETIME k", ":9999999999\r\n"},
+		{"PEXPIRETIME k", ":9999999999000\r\n"},
+		{"PEXPIREAT k 9999999999001 LT", ":0\r\n"},
+		{"PEXPIREAT k 9999999999001 GT", ":1\r\n"},
+		{"EXPIRE k 100 NX", ":0\r\n"},
+		{"PEXPIRE k 100000 xx", ":1\r\n"},
+		{"TTL k", ":100\r\n"},
+		{"PERSIST k", ":1\r\n"},
+		{"PERSIST k", ":0\r\n"},
+		{"TTL k", ":-1\r\n"},
+		{"PEXPIRE k -1", ":1\r\n"},
+		{"GET k", "$-1\r\n"},
+	} {
+		if actual := run(c, tc.line); actual != tc.expected {
+			t.Fatalf("%s: actual %q and expected %q mismatch", tc.line, actual, tc.expected)
+		}
+	}
+
+	run(c, "SET k v PX 100000")
+	reply := run(c, "PTTL k")
+	if ms, err := strconv.Atoi(strings.Trim(reply, ":\r\n")); err != nil || ms < 99000 || ms > 100000 {
+		t.Fatalf("unexpected PTTL %q", reply)
+	}
+}
+
+func TestStringCommands(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	c := s.NewClient(-1)
+
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		{"APPEND k 12", ":2\r\n"},
+		{"APPEND k ab", ":4\r\n"},
+		{"STRLEN k", ":4\r\n"},
+		{"STRLEN missing", ":0\r\n"},
+		{"INCR k", "-ERR value is not an integer or out of range\r\n"},
+		{"GETRANGE k 1 -2", "$2\r\n2a\r\n"},
+		{"GETRANGE k -100 100", "$4\r\n12ab\r\n"},
+		{"GETRANGE k 3 1", "$0\r\n\r\n"},
+		{"GETRANGE k -1 -2", "$0\r\n\r\n"},
+		{"GETRANGE missing 0 -1", "$0\r\n\r\n"},
+		{"GETRANGE k x 1", "-ERR value is not an integer or out of range\r\n"},
+		{"SETRANGE k -1 x", "-ERR offset is out of range\r\n"},
+		{"SETRANGE k 2 34", ":4\r\n"},
+		{"INCR k", ":1235\r\n"},
+		{"SETRANGE k 6 x", ":7\r\n"},
+		{"GET k", "$7\r\n1235\x00\x00x\r\n"},
+		{"SETRANGE k 9999999999 x", "-ERR string exceeds maximum allowed size (proto-max-bulk-len)\r\n"},
+		{"SETRANGE k 9223372036854775807 x", "-ERR string exceeds maximum allowed size (proto-max-bulk-len)\r\n"},
+		{"GETDEL k", "$7\r\n1235\x00\x00x\r\n"},
+		{"GETDEL k", "$-1\r\n"},
+		{"SETNX k v", ":1\r\n"},
+		{"SETNX k w", ":0\r\n"},
+		{"GETEX k EX 100 PERSIST", "-ERR syntax error\r\n"},
+		{"GETEX k PX 0", "-ERR invalid expire time in 'getex' command\r\n"},
+		{"GETEX k EX 100", "$1\r\nv\r\n"},
+		{"TTL k", ":100\r\n"},
+		{"GETEX k PERSIST", "$1\r\nv\r\n"},
+		{"TTL k", ":-1\r\n"},
+		{"GETEX k PXAT 1", "$1\r\nv\r\n"},
+		{"GETEX k", "$-1\r\n"},
+		{"SETEX k 0 v", "-ERR invalid expire time in 'setex' command\r\n"},
+		{"PSETEX k x v", "-ERR value is not an integer or out of range\r\n"},
+		{"SETEX k 100 v", "+OK\r\n"},
+		{"TTL k", ":100\r\n"},
+		{"PSETEX k 100000 w", "+OK\r\n"},
+		{"GET k", "$1\r\nw\r\n"},
+		{"SET key1 ohmytext", "+OK\r\n"},
+		{"SET key2 mynewtext", "+OK\r\n"},
+		{"LCS key1 key2", "$6\r\nmytext\r\n"},
+		{"LCS key1 key2 LEN", ":6\r\n"},
+		{"LCS key1 missing", "$0\r\n\r\n"},
+		{"LCS key1 key2 LEN IDX", "-ERR If you want both the length and indexes, please just use IDX.\r\n"},
+		{"LCS key1 key2 NOPE", "-ERR syntax error\r\n"},
+		{"LCS key1 key2 IDX", "*4\r\n$7\r\nmatches\r\n*2\r\n*2\r\n*2\r\n:4\r\n:7\r\n*2\r\n:5\r\n:8\r\n*2\r\n*2\r\n:2\r\n:3\r\n*2\r\n:0\r\n:1\r\n$3\r\nlen\r\n:6\r\n"},
+		{"LCS key1 key2 IDX MINMATCHLEN 4 WITHMATCHLEN", "*4\r\n$7\r\nmatches\r\n*1\r\n*3\r\n*2\r\n:4\r\n:7\r\n*2\r\n:5\r\n:8\r\n:4\r\n$3\r\nlen\r\n:6\r\n"},
+	} {
+		if actual := run(c, tc.line); actual != tc.expected {
+			t.Fatalf("%s: actual %q and expected %q mismatch", tc.line, actual, tc.expected)
+		}
+	}
+
+	// an empty value does not create the key
+	reply := executeCommand(&RedisCmd{Cmd: "SETRANGE", Args: []string{"missing", "0", ""}}, c)
+	if string(reply) != ":0\r\n" || s.dbs[0].Get("missing") != nil {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+
+	// the encoding follows the value
+	obj := s.dbs[0].Get("key1")
+	run(c, "SET n 12")
+	run(c, "APPEND n 3")
+	if GetEncoding(s.dbs[0].Get("n").TypeEncoding) != OBJ_ENCODING_INT || GetEncoding(obj.TypeEncoding) != OBJ_ENCODING_EMBSTR {
+		t.Fatalf("unexpected encodings")
+	}
+	run(c, "APPEND n x")
+	if GetEncoding(s.dbs[0].Get("n").TypeEncoding) != OBJ_ENCODING_EMBSTR {
+		t.Fatalf("APPEND did not change the encoding of an integer")
+	}
+}
+
+func TestNumericCommands(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	c := s.NewClient(-1)
+
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		{"INCR n", ":1\r\n"},
+		{"INCRBY n 10", ":11\r\n"},
+		{"DECR n", ":10\r\n"},
+		{"DECRBY n 20", ":-10\r\n"},
+		{"INCRBY n x", "-ERR value is not an integer or out of range\r\n"},
+		{"DECRBY n -9223372036854775808", "-ERR decrement would overflow\r\n"},
+		{"SET n 9223372036854775807", "+OK\r\n"},
+		{"INCR n", "-ERR increment or decrement would overflow\r\n"},
+		{"SET n -9223372036854775808", "+OK\r\n"},
+		{"DECR n", "-ERR increment or decrement would overflow\r\n"},
+		{"INCRBY n -1", "-ERR increment or decrement would overflow\r\n"},
+		{"SET n 007", "+OK\r\n"},
+		{"INCR n", "-ERR value is not an integer or out of range\r\n"},
+		{"SET f 10.50", "+OK\r\n"},
+		{"INCRBYFLOAT f 0.1", "$4\r\n10.6\r\n"},
+		{"INCRBYFLOAT f -5.6", "$1\r\n5\r\n"},
+		{"INCR f", ":6\r\n"},
+		{"INCRBYFLOAT f 5.0e3", "$4\r\n5006\r\n"},
+		{"INCRBYFLOAT f x", "-ERR value is not a valid float\r\n"},
+		{"INCRBYFLOAT f nan", "-ERR value is not a valid float\r\n"},
+		{"INCRBYFLOAT f 1.7976931348623157e308", "$309\r\n"},
+		{"INCRBYFLOAT f 1.7976931348623157e308", "-ERR increment would produce NaN or Infinity\r\n"},
+		{"SET s abc", "+OK\r\n"},
+		{"INCRBYFLOAT s 1", "-ERR value is not a valid float\r\n"},
+		{"INCRBYFLOAT missing 1.5", "$3\r\n1.5\r\n"},
+	} {
+		if actual := run(c, tc.line); !strings.HasPrefix(actual, tc.expected) {
+			t.Fatalf("%s: actual %q and expected %q mismatch", tc.line, actual, tc.expected)
+		}
+	}
+
+	// integers are stored natively
+	if obj := s.dbs[0].Get("n"); obj.Value != "007" {
+		t.Fatalf("a non canonical integer was converted: %#v", obj.Value)
+	}
+	run(c, "SET n 41")
+	run(c, "INCR n")
+	if obj := s.dbs[0].Get("n"); obj.Value != int64(42) {
+		t.Fatalf("unexpected value %#v", obj.Value)
+	}
+
+	// the float increment is logged as its result
+	if err := s.openAOF(); err != nil {
+		t.Fatal(err)
+	}
+	run(c, "SET f 1.5 EX 100")
+	executeCommand(&RedisCmd{Cmd: "INCRBYFLOAT", Args: []string{"f", "1"}}, c)
+	s.flushAppendOnlyFile()
+	data, err := os.ReadFile(s.config.AOFFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(data), string(Encode([]string{"SET", "f", "2.5", "KEEPTTL"}, false))) {
+		t.Fatalf("unexpected AOF %q", data)
+	}
+	if reply := run(c, "TTL f"); reply != ":100\r\n" {
+		t.Fatalf("INCRBYFLOAT dropped the TTL: %q", reply)
+	}
+}
+
+func TestMultiKeyStringCommands(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	c := s.NewClient(-1)
+
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		{"MSET a 1 b", "-ERR wrong number of arguments for 'mset' command\r\n"},
+		{"MSET a 1 b 2 a 3", "+OK\r\n"},
+		{"MGET a b missing", "*3\r\n$1\r\n3\r\n$1\r\n2\r\n$-1\r\n"},
+		{"MSETNX c 1 a 2", ":0\r\n"},
+		{"GET c", "$-1\r\n"},
+		{"MSETNX c 1 d 2", ":1\r\n"},
+		{"MGET c d", "*2\r\n$1\r\n1\r\n$1\r\n2\r\n"},
+		{"COMMAND GETKEYS mset a 1 b 2", "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+	} {
+		if actual := run(c, tc.line); actual != tc.expected {
+			t.Fatalf("%s: actual %q and expected %q mismatch", tc.line, actual, tc.expected)
+		}
+	}
+	c.proto = RESP3
+	if reply := run(c, "MGET a missing"); reply != "*2\r\n$1\r\n3\r\n_\r\n" {
+		t.Fatalf("unexpected RESP3 reply %q", reply)
+	}
+}
+
+func TestMSETRespectsKeysLimit(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	s.config.KeysLimit = 10
+	c := s.NewClient(-1)
+
+	run(c, "MSET a 1 b 2 c 3 d 4 e 5 f 6 g 7 h 8")
+	line := "MSET"
+	for i := 0; i < 6; i++ {
+		line += fmt.Sprintf(" k%d %d", i, i)
+	}
+	if reply := run(c, line); reply != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	if n := s.totalKeys(); n > 10 {
+		t.Fatalf("%d keys are over the limit", n)
+	}
+	// the keys of the MSET did not evict each other
+	for i := 0; i < 6; i++ {
+		if s.dbs[0].Get(fmt.Sprintf("k%d", i)) == nil {
+			t.Fatalf("k%d was evicted", i)
+		}
+	}
+
+	line = "MSET"
+	for i := 0; i < 11; i++ {
+		line += fmt.Sprintf(" big%d %d", i, i)
+	}
+	if reply := run(c, line); !strings.HasPrefix(reply, "-OOM") {
+		t.Fatalf("expected an OOM error got %q", reply)
+	}
+	if s.dbs[0].Get("k0") == nil {
+		t.Fatalf("keys were evicted for an MSET that was refused")
+	}
+}
+
+func TestDenyOOMCommands(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	s.config.KeysLimit = 2
+	s.config.EvictionStrategy = "noeviction"
+	c := s.NewClient(-1)
+
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		{"SET a 1", "+OK\r\n"},
+		{"SET b 2", "+OK\r\n"},
+		{"SET c 3", "-OOM command not allowed when the keys limit is reached\r\n"},
+		{"INCR a", "-OOM command not allowed when the keys limit is reached\r\n"},
+		{"GET a", "$1\r\n1\r\n"},
+		{"DEL a", ":1\r\n"},
+		{"SET c 3", "+OK\r\n"},
+	} {
+		if actual := run(c, tc.line); actual != tc.expected {
+			t.Fatalf("%s: actual %q and expected %q mismatch", tc.line, actual, tc.expected)
+		}
+	}
+
+	// a key is evicted to make room when the strategy allows it
+	s.config.EvictionStrategy = "simple-first"
+	if reply := run(c, "SET d 4"); reply != "+OK\r\n" || s.totalKeys() != 2 {
+		t.Fatalf("unexpected reply %q with %d keys", reply, s.totalKeys())
+	}
+}
+
+func TestGenericKeyCommands(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	c := s.NewClient(-1)
+
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		{"RANDOMKEY", "$-1\r\n"},
+		{"TYPE k", "+none\r\n"},
+		{"MSET a 1 b 2", "+OK\r\n"},
+		{"EXISTS a b a missing", ":3\r\n"},
+		{"TYPE a", "+string\r\n"},
+		{"RENAME missing x", "-ERR no such key\r\n"},
+		{"EXPIRE a 100", ":1\r\n"},
+		{"RENAME a c", "+OK\r\n"},
+		{"EXISTS a", ":0\r\n"},
+		{"TTL c", ":100\r\n"},
+		{"RENAME c c", "+OK\r\n"},
+		{"RENAMENX c b", ":0\r\n"},
+		{"RENAMENX c a", ":1\r\n"},
+		{"RENAME b a", "+OK\r\n"},
+		{"TTL a", ":-1\r\n"},
+		{"GET a", "$1\r\n2\r\n"},
+		{"SET a v EX 100", "+OK\r\n"},
+		{"COPY a a", "-ERR source and destination objects are the same\r\n"},
+		{"COPY a b DB", "-ERR syntax error\r\n"},
+		{"COPY a b DB 16", "-ERR DB index is out of range\r\n"},
+		{"COPY missing b", ":0\r\n"},
+		{"COPY a b", ":1\r\n"},
+		{"TTL b", ":100\r\n"},
+		{"SET a w", "+OK\r\n"},
+		{"COPY a b", ":0\r\n"},
+		{"COPY a b REPLACE", ":1\r\n"},
+		{"GET b", "$1\r\nw\r\n"},
+		{"TTL b", ":-1\r\n"},
+		{"COPY a a DB 1", ":1\r\n"},
+		{"UNLINK a b missing", ":2\r\n"},
+		{"TOUCH a b missing", ":0\r\n"},
+		{"SELECT 1", "+OK\r\n"},
+		{"TOUCH a a", ":2\r\n"},
+		{"RANDOMKEY", "$1\r\na\r\n"},
+		{"PEXPIREAT a 9999999999999", ":1\r\n"},
+		{"RANDOMKEY", "$1\r\na\r\n"},
+	} {
+		if actual := run(c, tc.line); actual != tc.expected {
+			t.Fatalf("%s: actual %q and expected %q mismatch", tc.line, actual, tc.expected)
+		}
+	}
+
+	// RANDOMKEY skips the expired keys
+	s.dbs[1].expires[s.dbs[1].dict["a"]] = 1
+	run(c, "SET b v")
+	if reply := run(c, "RANDOMKEY"); reply != "$1\r\nb\r\n" {
+		t.Fatalf("unexpected random key %q", reply)
+	}
+
+	// the copy does not share its value with the source
+	run(c, "COPY b c")
+	run(c, "APPEND c x")
+	if reply := run(c, "GET b"); reply != "$1\r\nv\r\n" {
+		t.Fatalf("the source was modified by its copy: %q", reply)
+	}
+}
+
+func TestLimitsPerStore(t *testing.T) {
+	t.Parallel()
+	small := newTestStore(t)
+	small.config.ProtoMaxBulkLen = 4
+	small.config.ClientQueryBufferLimit = 8
+	c := small.NewClient(-1)
+	other := newTestStore(t).NewClient(-1)
+
+	run(c, "SET k abc")
+	if reply := run(c, "APPEND k de"); reply != "-ERR string exceeds maximum allowed size (proto-max-bulk-len)\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	if reply := run(other, "APPEND k abcde"); reply != ":5\r\n" {
+		t.Fatalf("the limit of another store applied: %q", reply)
+	}
+
+	query := []byte("*2\r\n$3\r\nGET\r\n$5\r\nabcde\r\n")
+	c.queryBuf = append([]byte(nil), query...)
+	if _, err := c.DecodeQuery(); err == nil {
+		t.Fatalf("expected the bulk string to be refused")
+	}
+	other.queryBuf = append([]byte(nil), query...)
+	if _, err := other.DecodeQuery(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.queryBuf = make([]byte, 9)
+	if err := c.ReadQuery(); err == nil {
+		t.Fatalf("expected the query buffer limit to be exceeded")
+	}
+}
@@ -1,5 +1,61 @@
 package core
 
-func Shutdown() {
-	evalBGREWRITEAOF([]string{})
+import (
+	"os"
+)
+
+// Startup loads the dataset of s from disk and opens its AOF, before the
+// server starts accepting clients
+func (s *Store) Startup() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the AOF is the most up to date, the snapshot is loaded only without it
+	_, statErr := os.Stat(s.config.AOFFile)
+	aofExists := statErr == nil
+	var err error
+	if s.config.AppendOnly && aofExists {
+		err = s.LoadAOF()
+	} else {
+		err = s.LoadRDB()
+	}
+	if err != nil {
+		return err
+	}
+	s.rdb.dirtyAtLastSave = s.dirty
+
+	if !s.config.AppendOnly {
+		return nil
+	}
+	if err := s.openAOF(); err != nil {
+		return err
+	}
+	// a new AOF has to start with the dataset loaded from the snapshot
+	if !aofExists && s.totalKeys() > 0 {
+		return s.rewriteAppendOnlyFileBackground()
+	}
+	return nil
+}
+
+// Cron runs the periodic tasks, it is called from the event loop
+func (s *Store) Cron() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Active delete of expired keys
+	s.DeleteExpiredKeys()
+	s.flushAppendOnlyFile()
+	s.persistenceCron()
+}
+
+func (s *Store) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.abortAOFRewrite()
+	s.checkRDBSaveDone(true)
+	s.closeAOF()
+	if len(s.rdb.saveParams) > 0 {
+		s.rdbSaveSync()
+	}
 }
@@ -1,35 +1,76 @@
 package core
 
-import (
-	"github.com/savannahar68/echo-server/config"
-)
+import "errors"
+
+// errOOM is replied to the commands that would add more keys than the
+// eviction can make room for
+var errOOM = errors.New("OOM command not allowed when the keys limit is reached")
 
 // EvictFirst SimpleFirst whenever cache is full evict first key
-func EvictFirst() {
-	for k, _ := range store {
-		delete(store, k)
-		return
+func (s *Store) EvictFirst() {
+	for _, db := range s.dbs {
+		for k := range db.dict {
+			db.evict(k)
+			return
+		}
 	}
 }
 
-func Evict() {
-	switch config.EvictionStrategy {
+// Evict deletes keys according to the eviction strategy. Nothing is
+// evicted while the dataset is loaded, the files replay the evictions
+// that happened when they were written.
+func (s *Store) Evict() {
+	if s.loading {
+		return
+	}
+	switch s.config.EvictionStrategy {
 	case "simple-first":
-		EvictFirst()
+		s.EvictFirst()
 	case "allkeys-random":
-		EvictAllRandomKeys()
+		s.EvictAllRandomKeys()
 	case "allkeys-lru":
-		EvicAllKeysLru()
+		s.EvicAllKeysLru()
+	}
+}
+
+// canEvict reports whether the eviction strategy can delete a key
+func (s *Store) canEvict() bool {
+	switch s.config.EvictionStrategy {
+	case "simple-first", "allkeys-random", "allkeys-lru":
+		return s.totalKeys() > 0
 	}
+	return false
 }
 
-func EvictAllRandomKeys() {
-	evictCount := int64(config.EvictionRatio * float64(config.KeysLimit))
-	for k, _ := range store {
-		Del(k)
-		evictCount--
-		if evictCount <= 0 {
-			break
+// reserveKeys evicts keys until n new keys fit under the keys limit, so
+// that the keys added by a single command do not evict each other. It
+// fails without evicting anything when n alone is over the limit.
+func (s *Store) reserveKeys(n int) error {
+	if s.loading {
+		return nil
+	}
+	if n > s.config.KeysLimit {
+		return errOOM
+	}
+	for s.totalKeys()+n > s.config.KeysLimit {
+		before := s.totalKeys()
+		s.Evict()
+		if s.totalKeys() == before {
+			return errOOM
+		}
+	}
+	return nil
+}
+
+func (s *Store) EvictAllRandomKeys() {
+	evictCount := int64(s.config.EvictionRatio * float64(s.config.KeysLimit))
+	for _, db := range s.dbs {
+		for k := range db.dict {
+			db.evict(k)
+			evictCount--
+			if evictCount <= 0 {
+				return
+			}
 		}
 	}
 }
@@ -42,25 +83,34 @@ func getIdleTime(lastAccessedAt uint32) uint32 {
 	return (0x00FFFFF - lastAccessedAt) + c
 }
 
-func populateEvictionPool() {
+func (s *Store) populateEvictionPool() {
 	sampleSize := 5
-	for k := range store {
-		ePool.Push(k, store[k].LastAccessedAt)
-		sampleSize--
-		if sampleSize == 0 {
-			break
+	for _, db := range s.dbs {
+		for k := range db.dict {
+			s.ePool.Push(db, k, db.dict[k].LastAccessedAt)
+			sampleSize--
+			if sampleSize == 0 {
+				return
+			}
 		}
 	}
 }
 
-func EvicAllKeysLru() {
-	populateEvictionPool()
-	evictCount := int16(config.EvictionRatio * float64(config.KeysLimit))
-	for i := 0; i < int(evictCount) && len(ePool.pool) > 0; i++ {
-		item := ePool.Pop()
+func (s *Store) EvicAllKeysLru() {
+	s.populateEvictionPool()
+	evictCount := int16(s.config.EvictionRatio * float64(s.config.KeysLimit))
+	for i := 0; i < int(evictCount) && len(s.ePool.pool) > 0; i++ {
+		item := s.ePool.Pop()
 		if item == nil {
 			return
 		}
-		Del(item.key)
+		item.db.evict(item.key)
+	}
+}
+
+// evict deletes key and logs the deletion to the AOF
+func (db *DB) evict(key string) {
+	if db.Del(key) {
+		db.store.feedEviction(db, key)
 	}
 }
@@ -3,6 +3,7 @@ package core
 import "sort"
 
 type PoolItem struct {
+	db             *DB
 	key            string
 	lastAccessedAt uint32
 }
@@ -11,7 +12,13 @@ type PoolItem struct {
 // update the poolItem correponding to that
 type EvictionPool struct {
 	pool   []*PoolItem
-	keyset map[string]*PoolItem
+	keyset map[poolKey]*PoolItem
+}
+
+// poolKey identifies a key across the databases
+type poolKey struct {
+	db  *DB
+	key string
 }
 
 type ByIdleTime []*PoolItem
@@ -29,21 +36,21 @@ func (a ByIdleTime) Less(i, j int) bool {
 }
 
 // TODO: Make the implementation efficient to not need repeated sorting
-func (pq *EvictionPool) Push(key string, lastAccessedAt uint32) {
-	_, ok := pq.keyset[key]
+func (pq *EvictionPool) Push(db *DB, key string, lastAccessedAt uint32) {
+	_, ok := pq.keyset[poolKey{db, key}]
 	if ok {
 		return
 	}
-	item := &PoolItem{key: key, lastAccessedAt: lastAccessedAt}
+	item := &PoolItem{db: db, key: key, lastAccessedAt: lastAccessedAt}
 	if len(pq.pool) < ePoolSizeMax {
-		pq.keyset[key] = item
+		pq.keyset[poolKey{db, key}] = item
 		pq.pool = append(pq.pool, item)
 
 		// Performance bottleneck
 		sort.Sort(ByIdleTime(pq.pool))
 	} else if lastAccessedAt > pq.pool[0].lastAccessedAt {
 		pq.pool = pq.pool[1:]
-		pq.keyset[key] = item
+		pq.keyset[poolKey{db, key}] = item
 		pq.pool = append(pq.pool, item)
 	}
 }
@@ -54,16 +61,15 @@ func (pq *EvictionPool) Pop() *PoolItem {
 	}
 	item := pq.pool[0]
 	pq.pool = pq.pool[1:]
-	delete(pq.keyset, item.key)
+	delete(pq.keyset, poolKey{item.db, item.key})
 	return item
 }
 
 func newEvictionPool(size int) *EvictionPool {
 	return &EvictionPool{
 		pool:   make([]*PoolItem, size),
-		keyset: make(map[string]*PoolItem),
+		keyset: make(map[poolKey]*PoolItem),
 	}
 }
 
 var ePoolSizeMax int = 16
-var ePool *EvictionPool = newEvictionPool(0)
@@ -4,31 +4,41 @@ import (
 	"time"
 )
 
-func HasExpired(obj *Obj) bool {
-	exp, ok := expires[obj]
+func (db *DB) HasExpired(obj *Obj) bool {
+	exp, ok := db.expires[obj]
 	if !ok {
 		return false
 	}
 	return exp <= uint64(time.Now().UnixMilli())
 }
 
-func getExpiry(obj *Obj) (uint64, bool) {
-	exp, ok := expires[obj]
+func (db *DB) getExpiry(obj *Obj) (uint64, bool) {
+	exp, ok := db.expires[obj]
 	return exp, ok
 }
 
+// persist removes the TTL of obj, it returns false when it had none
+func (db *DB) persist(obj *Obj) bool {
+	if _, ok := db.expires[obj]; !ok {
+		return false
+	}
+	delete(db.expires, obj)
+	db.store.dirty++
+	return true
+}
+
 // TODO: Optimize
 //   - Sampling
 //   - Unnecessary iteration
-func expireSample() float32 {
+func (db *DB) expireSample() float32 {
 	var limit int = 20
 	var expiredCount int = 0
 
 	// assuming iteration of golang hash table in randomized
-	for key, obj := range store {
+	for key, obj := range db.dict {
 		limit--
-		if HasExpired(obj) {
-			Del(key)
+		if db.HasExpired(obj) {
+			db.Del(key)
 			expiredCount++
 		}
 
@@ -44,13 +54,15 @@ func expireSample() float32 {
 
 // Deletes all the expired keys - the active way
 // Sampling approach: https://redis.io/commands/expire/
-func DeleteExpiredKeys() {
-	for {
-		frac := expireSample()
-		// if the sample had less than 25% keys expired
-		// we break the loop.
-		if frac < 0.25 {
-			break
+func (s *Store) DeleteExpiredKeys() {
+	for _, db := range s.dbs {
+		for {
+			frac := db.expireSample()
+			// if the sample had less than 25% keys expired
+			// we break the loop.
+			if frac < 0.25 {
+				break
+			}
 		}
 	}
 }
@@ -0,0 +1,86 @@
+package core
+
+// globMatch reports whether s matches the glob-style pattern of KEYS and
+// SCAN: * matches any sequence, ? any byte, [abc], [^abc] and [a-z] a
+// byte of a set and \ escapes the next byte. On a mismatch only the last
+// * is retried one byte further, the earlier ones can not match more of
+// s than it does, so that the cost stays in O(len(pattern) * len(s))
+// whatever the number of stars.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	// the position in pattern of the last * and in s of what it matched up to
+	star, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				star, starI = p, i
+				p++
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if ok, rest := matchClass(pattern[p+1:], s[i]); ok {
+					p = len(pattern) - len(rest)
+					i++
+					continue
+				}
+			default:
+				c, next := pattern[p], p+1
+				if c == '\\' && next < len(pattern) {
+					c, next = pattern[next], next+1
+				}
+				if c == s[i] {
+					p = next
+					i++
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// let the last * match one more byte
+		starI++
+		p, i = star+1, starI
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches c against the set of a [...] pattern, pattern
+// starting after the opening bracket, and returns the rest of the pattern
+// after the closing one. An unterminated set runs to the end of the pattern.
+func matchClass(pattern string, c byte) (bool, string) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+
+	match := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			match = match || pattern[1] == c
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			match = match || (c >= lo && c <= hi)
+			pattern = pattern[3:]
+		default:
+			match = match || pattern[0] == c
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return match != negate, pattern
+}
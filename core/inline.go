@@ -0,0 +1,137 @@
+package core
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// maxInlineLen is the longest inline command accepted, past that the
+// client is most likely sending garbage
+const maxInlineLen = 64 * 1024
+
+// readInline reads an inline command, the space separated form typed by
+// humans through telnet or netcat, terminated by "\n" or "\r\n". It returns
+// the arguments as an array of strings so that inline commands flow through
+// the same path as RESP arrays, the delta and parsing error if any.
+// Example of inline command "SET key \"hello world\"\r\n"
+func readInline(data []byte) ([]interface{}, int, error) {
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		if len(data) > maxInlineLen {
+			return nil, 0, &ProtocolError{"too big inline request"}
+		}
+		return nil, 0, ErrIncomplete
+	}
+
+	line := data[:end]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	tokens, err := splitArgs(string(line))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	elements := make([]interface{}, len(tokens))
+	for i := range tokens {
+		elements[i] = tokens[i]
+	}
+	return elements, end + 1, nil
+}
+
+// splitArgs splits line into arguments the way redis-cli does: arguments
+// are separated by spaces and can be wrapped in double quotes, supporting
+// \n \r \t \b \a \xHH and \" escapes, or single quotes, supporting \'
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		// skip blanks
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var sb strings.Builder
+		switch line[i] {
+		case '"':
+			i++
+			for {
+				if i == len(line) {
+					return nil, &ProtocolError{"unbalanced quotes in request"}
+				}
+				ch := line[i]
+				if ch == '"' {
+					i++
+					break
+				}
+				if ch == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					sb.WriteByte(byte(b))
+					i += 4
+					continue
+				}
+				if ch == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						ch = '\n'
+					case 'r':
+						ch = '\r'
+					case 't':
+						ch = '\t'
+					case 'b':
+						ch = '\b'
+					case 'a':
+						ch = '\a'
+					default:
+						ch = line[i]
+					}
+				}
+				sb.WriteByte(ch)
+				i++
+			}
+		case '\'':
+			i++
+			for {
+				if i == len(line) {
+					return nil, &ProtocolError{"unbalanced quotes in request"}
+				}
+				ch := line[i]
+				if ch == '\'' {
+					i++
+					break
+				}
+				if ch == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					ch = '\''
+				}
+				sb.WriteByte(ch)
+				i++
+			}
+		default:
+			for i < len(line) && !isSpace(line[i]) {
+				sb.WriteByte(line[i])
+				i++
+			}
+		}
+
+		// a closing quote must be followed by a blank or the end of line
+		if i < len(line) && !isSpace(line[i]) {
+			return nil, &ProtocolError{"unbalanced quotes in request"}
+		}
+		args = append(args, sb.String())
+	}
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\v' || b == '\f'
+}
+
+func isHexDigit(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
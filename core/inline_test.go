@@ -0,0 +1,39 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestReadInline(t *testing.T) {
+	cases := map[string][]string{
+		"PING\r\n":                         {"PING"},
+		"SET  key value\n":                 {"SET", "key", "value"},
+		"SET key \"hello world\"\r\n":      {"SET", "key", "hello world"},
+		"SET key \"a\\r\\n\\x41\\\"\"\r\n": {"SET", "key", "a\r\nA\""},
+		"SET key 'it\\'s'\r\n":             {"SET", "key", "it's"},
+		"SET key \"\"\r\n":                 {"SET", "key", ""},
+		"\r\n":                             {},
+	}
+	for k, v := range cases {
+		value, delta, err := readInline([]byte(k))
+		if err != nil || delta != len(k) {
+			t.Errorf("%q: got %d %v", k, delta, err)
+			continue
+		}
+		if fmt.Sprintf("%q", value) != fmt.Sprintf("%q", v) {
+			t.Errorf("%q: actual %q and expected %q mismatch", k, value, v)
+		}
+	}
+}
+
+func TestReadInlineErrors(t *testing.T) {
+	if _, _, err := readInline([]byte("GET key")); err != ErrIncomplete {
+		t.Errorf("expected ErrIncomplete got %v", err)
+	}
+	for _, k := range []string{"SET key \"value\r\n", "SET key 'value\r\n", "SET key \"a\"b\r\n"} {
+		if _, _, err := readInline([]byte(k)); err == nil || err == ErrIncomplete {
+			t.Errorf("%q: expected a protocol error got %v", k, err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package core
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Keyspace is a typed API over one database of a store for the Go programs
+// embedding the engine. Its calls run the commands as a connected client
+// would, through the same eviction, expiry and persistence, and are safe
+// to use concurrently with the event loop and with each other.
+type Keyspace struct {
+	s *Store
+	// c executes the commands, it is only used with s.mu held
+	c *Client
+}
+
+// Keyspace returns the API over the database of s numbered db
+func (s *Store) Keyspace(db int) (*Keyspace, error) {
+	if db < 0 || db >= len(s.dbs) {
+		return nil, errors.New("ERR DB index is out of range")
+	}
+	c := s.NewClient(-1)
+	c.db = s.dbs[db]
+	return &Keyspace{s: s, c: c}, nil
+}
+
+// Get returns the value of key, ok is false when key does not exist
+func (ks *Keyspace) Get(key string) (value string, ok bool, err error) {
+	v, err := ks.Do("GET", key)
+	if err != nil || v == nil {
+		return "", false, err
+	}
+	return v.(string), true, nil
+}
+
+// Set sets key to value, the key expires after ttl unless it is 0
+func (ks *Keyspace) Set(key, value string, ttl time.Duration) error {
+	args := []string{"SET", key, value}
+	if ttl > 0 {
+		args = append(args, "PX", formatTTL(ttl))
+	}
+	_, err := ks.Do(args...)
+	return err
+}
+
+// Del deletes keys and returns how many of them existed
+func (ks *Keyspace) Del(keys ...string) (int64, error) {
+	v, err := ks.Do(append([]string{"DEL"}, keys...)...)
+	if err != nil {
+		return 0, err
+	}
+	return v.(int64), nil
+}
+
+// Incr increments the integer stored at key and returns its new value
+func (ks *Keyspace) Incr(key string) (int64, error) {
+	v, err := ks.Do("INCR", key)
+	if err != nil {
+		return 0, err
+	}
+	return v.(int64), nil
+}
+
+// Expire makes key expire after ttl, it returns false when key does not exist
+func (ks *Keyspace) Expire(key string, ttl time.Duration) (bool, error) {
+	v, err := ks.Do("PEXPIRE", key, formatTTL(ttl))
+	if err != nil {
+		return false, err
+	}
+	return v.(int64) == 1, nil
+}
+
+// formatTTL formats ttl in milliseconds, a positive TTL is rounded up so
+// that the key does not expire right away
+func formatTTL(ttl time.Duration) string {
+	ms := ttl.Milliseconds()
+	if ttl > 0 && ttl%time.Millisecond != 0 {
+		ms++
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+// Scan returns a few keys matching the glob-style pattern match, all
+// the keys when it is empty, and the cursor of the next call, 0 once the
+// iteration is complete. The first call is made with the cursor 0. A
+// key present for the whole iteration is returned at least once.
+func (ks *Keyspace) Scan(cursor uint64, match string, count int) ([]string, uint64, error) {
+	args := []string{"SCAN", strconv.FormatUint(cursor, 10)}
+	if match != "" {
+		args = append(args, "MATCH", match)
+	}
+	if count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(count))
+	}
+	v, err := ks.Do(args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reply := v.([]interface{})
+	next, err := strconv.ParseUint(reply[0].(string), 10, 64)
+	if err != nil {
+		return nil, 0, err
+	}
+	keys := make([]string, len(reply[1].([]interface{})))
+	for i, key := range reply[1].([]interface{}) {
+		keys[i] = key.(string)
+	}
+	return keys, next, nil
+}
+
+// Do runs the command args and returns its decoded reply: a string, an
+// int64, a []interface{} or nil. An error reply is returned as an error.
+// It covers the commands without a typed method.
+func (ks *Keyspace) Do(args ...string) (interface{}, error) {
+	replies, err := ks.do(args)
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// do runs the commands argvs atomically and returns their decoded
+// replies, it stops at the first error reply
+func (ks *Keyspace) do(argvs ...[]string) ([]interface{}, error) {
+	for _, argv := range argvs {
+		if len(argv) == 0 {
+			return nil, errors.New("ERR empty command")
+		}
+		// the Keyspace has no connection to hold the state of a
+		// transaction, and stays on its database
+		if command := LookupCommand(argv[0]); command != nil && (txnCommands[command.Name] || command.Name == "select") {
+			return nil, errors.New("ERR " + command.Name + " is not supported by the Go API")
+		}
+	}
+
+	ks.s.mu.Lock()
+	defer ks.s.mu.Unlock()
+	defer ks.s.flushAppendOnlyFile()
+
+	replies := make([]interface{}, 0, len(argvs))
+	for _, argv := range argvs {
+		reply := executeCommand(&RedisCmd{Cmd: argv[0], Args: argv[1:]}, ks.c)
+		if reply[0] == '-' {
+			return replies, errors.New(string(reply[1 : len(reply)-2]))
+		}
+		value, _, err := ks.s.decoder().decodeOne(reply, 0)
+		if err != nil {
+			return replies, err
+		}
+		replies = append(replies, value)
+	}
+	return replies, nil
+}
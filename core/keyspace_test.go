@@ -0,0 +1,132 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyspace(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	if err := s.openAOF(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Keyspace(16); err == nil {
+		t.Fatalf("expected an out of range error")
+	}
+	ks, err := s.Keyspace(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := ks.Get("ks-k"); ok || err != nil {
+		t.Fatalf("a missing key was found: %v", err)
+	}
+	if err := ks.Set("ks-k", "nil", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := ks.Get("ks-k"); v != "nil" || !ok || err != nil {
+		t.Fatalf("unexpected value %q, %v, %v", v, ok, err)
+	}
+	if _, ok := s.dbs[1].getExpiry(s.dbs[1].Get("ks-k")); !ok {
+		t.Fatalf("the TTL was not set")
+	}
+	// a TTL under a millisecond is not refused as an expire time of 0,
+	// nor does it delete the key right away
+	if err := ks.Set("ks-short", "v", time.Microsecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.dbs[1].getExpiry(s.dbs[1].dict["ks-short"]); !ok {
+		t.Fatalf("the TTL was not set")
+	}
+	if ok, err := ks.Expire("ks-short", 500*time.Microsecond); !ok || err != nil {
+		t.Fatalf("the TTL was not updated: %v", err)
+	}
+	if s.dbs[1].dict["ks-short"] == nil {
+		t.Fatalf("the key was deleted by a TTL under a millisecond")
+	}
+	if _, err := ks.Del("ks-short"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Incr("ks-k"); err == nil {
+		t.Fatalf("expected an error incrementing a string")
+	}
+	if n, err := ks.Incr("ks-n"); n != 1 || err != nil {
+		t.Fatalf("unexpected increment %d, %v", n, err)
+	}
+	if ok, err := ks.Expire("ks-missing", time.Minute); ok || err != nil {
+		t.Fatalf("expired a missing key: %v", err)
+	}
+
+	var keys []string
+	for cursor := uint64(0); ; {
+		batch, next, err := ks.Scan(cursor, "ks-*", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, batch...)
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	if len(keys) != 2 {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if n, err := ks.Del("ks-k", "ks-n", "ks-missing"); n != 2 || err != nil {
+		t.Fatalf("unexpected deletions %d, %v", n, err)
+	}
+	if _, err := ks.Do("MULTI"); err == nil {
+		t.Fatalf("expected MULTI to be refused")
+	}
+	if _, err := ks.Do("SELECT", "2"); err == nil || ks.c.db.ID != 1 {
+		t.Fatalf("expected SELECT to be refused")
+	}
+	if len(s.dbs[0].dict) != 0 {
+		t.Fatalf("the keys were written to the wrong database")
+	}
+
+	data, err := os.ReadFile(s.config.AOFFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "SELECT\r\n$1\r\n1\r\n") || !strings.Contains(string(data), "PXAT") {
+		t.Fatalf("the writes were not logged: %q", data)
+	}
+}
+
+func TestKeyspaceConcurrentAccess(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	c := s.NewClient(-1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		ks, err := s.Keyspace(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ks.Incr("counter")
+				ks.Set(fmt.Sprintf("k%d", i), "v", 0)
+				s.Cron()
+			}
+		}(i)
+	}
+	for j := 0; j < 100; j++ {
+		s.mu.Lock()
+		processCommand(&RedisCmd{Cmd: "INCR", Args: []string{"counter"}}, c)
+		s.mu.Unlock()
+	}
+	wg.Wait()
+
+	if reply := run(c, "GET counter"); reply != "$3\r\n500\r\n" {
+		t.Fatalf("unexpected counter %q", reply)
+	}
+}
@@ -0,0 +1,535 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The snapshot is a binary, point in time dump of the keyspace:
+//
+//	"ECHODB" <4 digits version>
+//	<0xFA aux key, aux value>...
+//	<0xFE db number> then for every key: [<0xFC 8 bytes expiry>] <type> <key> <value>
+//	<0xFF> <8 bytes CRC64 of everything before>
+//
+// Numbers are little endian, lengths are unsigned varints and strings are
+// length prefixed.
+const RDB_MAGIC string = "ECHODB"
+const RDB_VERSION int = 1
+
+// Opcodes, they share the byte space of the value types
+const RDB_OPCODE_AUX byte = 0xFA
+const RDB_OPCODE_EXPIRETIME_MS byte = 0xFC
+const RDB_OPCODE_SELECTDB byte = 0xFE
+const RDB_OPCODE_EOF byte = 0xFF
+
+// Value types
+const RDB_TYPE_STRING byte = 0
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// rdbWriter writes the snapshot primitives and checksums what it writes
+type rdbWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash64
+	err error
+}
+
+func newRDBWriter(w io.Writer) *rdbWriter {
+	crc := crc64.New(crcTable)
+	return &rdbWriter{w: bufio.NewWriter(io.MultiWriter(w, crc)), crc: crc}
+}
+
+func (rw *rdbWriter) write(b []byte) {
+	if rw.err == nil {
+		_, rw.err = rw.w.Write(b)
+	}
+}
+
+func (rw *rdbWriter) writeLen(n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	rw.write(b[:binary.PutUvarint(b[:], n)])
+}
+
+func (rw *rdbWriter) writeString(s string) {
+	rw.writeLen(uint64(len(s)))
+	rw.write([]byte(s))
+}
+
+func (rw *rdbWriter) writeUint64(v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	rw.write(b[:])
+}
+
+// writeObject writes the key of e, preceded by its expiry if it has one
+func (rw *rdbWriter) writeObject(e snapshotEntry) error {
+	if e.expireAt != 0 {
+		rw.write([]byte{RDB_OPCODE_EXPIRETIME_MS})
+		rw.writeUint64(e.expireAt)
+	}
+
+	switch GetType(e.obj.TypeEncoding) {
+	case OBJ_TYPE_STRING:
+		rw.write([]byte{RDB_TYPE_STRING})
+		rw.writeString(e.key)
+		rw.writeString(getString(&e.obj))
+	default:
+		return fmt.Errorf("unknown type %d of key %q", GetType(e.obj.TypeEncoding), e.key)
+	}
+	return rw.err
+}
+
+// writeRDB writes a complete snapshot of entries to w
+func writeRDB(w io.Writer, entries []snapshotEntry) error {
+	rw := newRDBWriter(w)
+	rw.write([]byte(fmt.Sprintf("%s%04d", RDB_MAGIC, RDB_VERSION)))
+	rw.write([]byte{RDB_OPCODE_AUX})
+	rw.writeString("ctime")
+	rw.writeString(strconv.FormatInt(time.Now().Unix(), 10))
+
+	db := -1
+	for _, e := range entries {
+		if e.db != db {
+			db = e.db
+			rw.write([]byte{RDB_OPCODE_SELECTDB})
+			rw.writeLen(uint64(db))
+		}
+		if err := rw.writeObject(e); err != nil {
+			return err
+		}
+	}
+	rw.write([]byte{RDB_OPCODE_EOF})
+	if rw.err == nil {
+		rw.err = rw.w.Flush()
+	}
+	if rw.err != nil {
+		return rw.err
+	}
+
+	// the checksum is not part of what it covers
+	var sum [8]byte
+	binary.LittleEndian.PutUint64(sum[:], rw.crc.Sum64())
+	_, err := w.Write(sum[:])
+	return err
+}
+
+// rdbReader reads the snapshot primitives and checksums what it reads
+type rdbReader struct {
+	r   *bufio.Reader
+	crc hash.Hash64
+	// offset is the number of bytes read so far
+	offset int64
+	// maxLen is the largest string accepted
+	maxLen int
+}
+
+func (rr *rdbReader) ReadByte() (byte, error) {
+	b, err := rr.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	rr.crc.Write([]byte{b})
+	rr.offset++
+	return b, nil
+}
+
+func (rr *rdbReader) read(n uint64) ([]byte, error) {
+	// do not trust a corrupted length for the allocation
+	if n > uint64(rr.maxLen) {
+		return nil, fmt.Errorf("invalid length %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, b); err != nil {
+		return nil, err
+	}
+	rr.crc.Write(b)
+	rr.offset += int64(n)
+	return b, nil
+}
+
+func (rr *rdbReader) readLen() (uint64, error) {
+	return binary.ReadUvarint(rr)
+}
+
+func (rr *rdbReader) readString() (string, error) {
+	n, err := rr.readLen()
+	if err != nil {
+		return "", err
+	}
+	b, err := rr.read(n)
+	return string(b), err
+}
+
+// readRDB reads a snapshot from r and calls fn for every key. It stops
+// right after the checksum, leaving what follows in r, and returns the
+// size of the snapshot. Strings longer than maxLen are refused.
+func readRDB(r *bufio.Reader, maxLen int, fn func(e snapshotEntry) error) (int64, error) {
+	rr := &rdbReader{r: r, crc: crc64.New(crcTable), maxLen: maxLen}
+	if err := readRDBBody(rr, fn); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return rr.offset, fmt.Errorf("%v at offset %d", err, rr.offset)
+	}
+	return rr.offset, nil
+}
+
+func readRDBBody(rr *rdbReader, fn func(e snapshotEntry) error) error {
+	header, err := rr.read(uint64(len(RDB_MAGIC) + 4))
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(header, []byte(RDB_MAGIC)) {
+		return errors.New("wrong signature")
+	}
+	version, err := strconv.Atoi(string(header[len(RDB_MAGIC):]))
+	if err != nil || version < 1 || version > RDB_VERSION {
+		return fmt.Errorf("can't handle snapshot format version %q", header[len(RDB_MAGIC):])
+	}
+
+	db := 0
+	var expireAt uint64
+	for {
+		opcode, err := rr.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case RDB_OPCODE_EOF:
+			expected := rr.crc.Sum64()
+			sum, err := rr.read(8)
+			if err != nil {
+				return err
+			}
+			if binary.LittleEndian.Uint64(sum) != expected {
+				return errors.New("wrong checksum")
+			}
+			return nil
+
+		case RDB_OPCODE_AUX:
+			if _, err := rr.readString(); err != nil {
+				return err
+			}
+			if _, err := rr.readString(); err != nil {
+				return err
+			}
+
+		case RDB_OPCODE_SELECTDB:
+			n, err := rr.readLen()
+			if err != nil {
+				return err
+			}
+			db = int(n)
+
+		case RDB_OPCODE_EXPIRETIME_MS:
+			b, err := rr.read(8)
+			if err != nil {
+				return err
+			}
+			expireAt = binary.LittleEndian.Uint64(b)
+
+		case RDB_TYPE_STRING:
+			key, err := rr.readString()
+			if err != nil {
+				return err
+			}
+			value, err := rr.readString()
+			if err != nil {
+				return err
+			}
+			oType, oEnc := DeduceTypeEncoding(value)
+			e := snapshotEntry{db: db, key: key, obj: Obj{TypeEncoding: oType | oEnc, Value: stringObjValue(value, oEnc)}, expireAt: expireAt}
+			if err := fn(e); err != nil {
+				return err
+			}
+			expireAt = 0
+
+		default:
+			return fmt.Errorf("unknown opcode %d", opcode)
+		}
+	}
+}
+
+// rdbState tracks the snapshots of a store. The background save works on
+// a point in time copy of the keyspace like the AOF rewrite does.
+type rdbState struct {
+	inProgress bool
+	start      time.Time
+	tmpFile    string
+	done       chan error
+	// dirtyBefore is the dirty counter when the save started, the
+	// changes made after it are not part of the snapshot
+	dirtyBefore int64
+
+	lastStatus   string
+	lastTry      time.Time
+	lastDuration time.Duration
+
+	// lastSave is the time of the last successful save, dirtyAtLastSave
+	// the value of the dirty counter it covers
+	lastSave        time.Time
+	dirtyAtLastSave int64
+
+	// saveScheduled is set by BGSAVE SCHEDULE during an AOF rewrite
+	saveScheduled bool
+	saveParams    []saveParam
+}
+
+// saveParam is a "save <seconds> <changes>" point: the snapshot is saved
+// when at least Changes changes were made in the last Seconds seconds
+type saveParam struct {
+	Seconds int64
+	Changes int64
+}
+
+// parseSaveParams parses the save points of Config.Save, pairs of
+// seconds and changes separated by spaces such as "3600 1 300 100"
+func parseSaveParams(s string) ([]saveParam, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save parameters %q", s)
+	}
+	var params []saveParam
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.ParseInt(fields[i], 10, 64)
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, fmt.Errorf("invalid save parameters %q", s)
+		}
+		params = append(params, saveParam{Seconds: seconds, Changes: changes})
+	}
+	return params, nil
+}
+
+// hasActiveChild reports whether a background save or rewrite is running
+func (s *Store) hasActiveChild() bool {
+	return s.aof.rewrite.inProgress || s.rdb.inProgress
+}
+
+// rdbSaveTo writes the snapshot to a temporary file and renames it to file
+func rdbSaveTo(file string, entries []snapshotEntry) error {
+	fp, err := createTempFile(file, "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	if err := writeRDBFile(fp, entries); err != nil {
+		os.Remove(fp.Name())
+		return err
+	}
+	return os.Rename(fp.Name(), file)
+}
+
+// createTempFile creates a file with a unique name in the directory of
+// file, to be renamed to it once written. The name is unique for the
+// stores of one process sharing the directory too.
+func createTempFile(file, pattern string) (*os.File, error) {
+	fp, err := os.CreateTemp(filepath.Dir(file), pattern)
+	if err != nil {
+		return nil, err
+	}
+	if err := fp.Chmod(0644); err != nil {
+		fp.Close()
+		os.Remove(fp.Name())
+		return nil, err
+	}
+	return fp, nil
+}
+
+// writeRDBFile writes the snapshot to fp and closes it
+func writeRDBFile(fp *os.File, entries []snapshotEntry) error {
+	if err := writeRDB(fp, entries); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// rdbSaveSync saves the snapshot on the event loop
+func (s *Store) rdbSaveSync() error {
+	if s.rdb.inProgress {
+		return errors.New("ERR Background save already in progress")
+	}
+
+	start := time.Now()
+	dirtyBefore := s.dirty
+	if err := rdbSaveTo(s.config.RDBFile, s.snapshotKeyspace()); err != nil {
+		log.Println("error saving the DB on disk", err)
+		s.rdb.lastStatus = "err"
+		return err
+	}
+	log.Printf("DB saved on disk in %.3f seconds", time.Since(start).Seconds())
+	s.rdb.lastStatus = "ok"
+	s.rdb.lastSave = time.Now()
+	s.rdb.dirtyAtLastSave = dirtyBefore
+	return nil
+}
+
+// rdbSaveBackground starts saving the snapshot off the event loop
+func (s *Store) rdbSaveBackground() error {
+	if s.rdb.inProgress {
+		return errors.New("ERR Background save already in progress")
+	}
+	if s.aof.rewrite.inProgress {
+		return errors.New("ERR Another child process is active (AOF?): can't BGSAVE right now. " +
+			"Use BGSAVE SCHEDULE in order to schedule a BGSAVE whenever possible.")
+	}
+
+	entries := s.snapshotKeyspace()
+	s.rdb.inProgress = true
+	s.rdb.start = time.Now()
+	s.rdb.lastTry = s.rdb.start
+	s.rdb.dirtyBefore = s.dirty
+	s.rdb.done = make(chan error, 1)
+
+	log.Println("background saving started")
+	go func(done chan<- error) {
+		done <- rdbSaveTo(s.config.RDBFile, entries)
+	}(s.rdb.done)
+	return nil
+}
+
+// checkRDBSaveDone collects the result of the background save
+func (s *Store) checkRDBSaveDone(wait bool) {
+	if !s.rdb.inProgress {
+		return
+	}
+
+	var err error
+	if wait {
+		err = <-s.rdb.done
+	} else {
+		select {
+		case err = <-s.rdb.done:
+		default:
+			return
+		}
+	}
+
+	if err != nil {
+		log.Println("background saving error", err)
+		s.rdb.lastStatus = "err"
+	} else {
+		log.Println("background saving terminated with success")
+		s.rdb.lastStatus = "ok"
+		s.rdb.lastSave = time.Now()
+		s.rdb.dirtyAtLastSave = s.rdb.dirtyBefore
+	}
+	s.rdb.lastDuration = time.Since(s.rdb.start)
+	s.rdb.inProgress = false
+}
+
+// persistenceCron collects the background jobs, starts the scheduled
+// ones and saves the snapshot when a save point is reached
+func (s *Store) persistenceCron() {
+	s.checkRDBSaveDone(false)
+	s.checkAOFRewriteDone(false)
+	if s.hasActiveChild() {
+		return
+	}
+
+	if s.aof.rewriteScheduled {
+		s.aof.rewriteScheduled = false
+		if err := s.rewriteAppendOnlyFileBackground(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if s.rdb.saveScheduled {
+		s.rdb.saveScheduled = false
+		if err := s.rdbSaveBackground(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	// after a failure wait a bit before retrying
+	if s.rdb.lastStatus != "ok" && time.Since(s.rdb.lastTry) < 5*time.Second {
+		return
+	}
+	changes := s.dirty - s.rdb.dirtyAtLastSave
+	for _, sp := range s.rdb.saveParams {
+		if changes >= sp.Changes && changes > 0 && time.Since(s.rdb.lastSave) > time.Duration(sp.Seconds)*time.Second {
+			log.Printf("%d changes in %d seconds. Saving...", sp.Changes, sp.Seconds)
+			if err := s.rdbSaveBackground(); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+	}
+}
+
+// LoadRDB restores the dataset from the snapshot file, if there is one
+func (s *Store) LoadRDB() error {
+	fp, err := os.Open(s.config.RDBFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	s.loading = true
+	defer func() { s.loading = false }()
+
+	start := time.Now()
+	keys, _, err := s.loadSnapshot(bufio.NewReader(fp))
+	if err != nil {
+		return fmt.Errorf("bad snapshot file %s: %v", s.config.RDBFile, err)
+	}
+
+	log.Printf("DB loaded from disk: %.3f seconds, %d keys", time.Since(start).Seconds(), keys)
+	s.rdb.dirtyAtLastSave = s.dirty
+	return nil
+}
+
+// loadSnapshot restores the keys of the snapshot read from r, skipping
+// the ones that expired while the server was down. It returns the number
+// of keys restored and the size of the snapshot.
+func (s *Store) loadSnapshot(r *bufio.Reader) (int, int64, error) {
+	keys := 0
+	now := uint64(time.Now().UnixMilli())
+	n, err := readRDB(r, s.config.ProtoMaxBulkLen, func(e snapshotEntry) error {
+		if e.expireAt != 0 && e.expireAt <= now {
+			return nil
+		}
+		if err := s.restoreEntry(e); err != nil {
+			return err
+		}
+		keys++
+		return nil
+	})
+	return keys, n, err
+}
+
+// restoreEntry adds the key of e to its database
+func (s *Store) restoreEntry(e snapshotEntry) error {
+	if e.db >= len(s.dbs) {
+		return fmt.Errorf("database %d of key %q is out of range, the server has %d databases", e.db, e.key, len(s.dbs))
+	}
+	db := s.dbs[e.db]
+	obj := e.obj
+	db.Put(e.key, &obj)
+	if e.expireAt != 0 {
+		db.setExpireAt(&obj, e.expireAt)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSaveAndLoadRDB(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+
+	c := s.NewClient(-1)
+	executeCommand(&RedisCmd{Cmd: "SET", Args: []string{"rdb-ttl", "hello world", "EX", "100"}}, c)
+	executeCommand(&RedisCmd{Cmd: "SET", Args: []string{"rdb-int", "42"}}, c)
+	exp, _ := s.dbs[0].getExpiry(s.dbs[0].Get("rdb-ttl"))
+
+	if reply := run(c, "BGSAVE"); reply != "+Background saving started\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	if reply := run(c, "BGSAVE"); !strings.HasPrefix(reply, "-ERR") {
+		t.Fatalf("expected a save in progress error got %q", reply)
+	}
+	s.checkRDBSaveDone(true)
+	if s.rdb.lastStatus != "ok" {
+		t.Fatalf("background save failed")
+	}
+	if s.dirty != s.rdb.dirtyAtLastSave {
+		t.Fatalf("the save does not cover %d changes", s.dirty-s.rdb.dirtyAtLastSave)
+	}
+
+	s.dbs[0].Del("rdb-ttl")
+	s.dbs[0].Del("rdb-int")
+	if err := s.LoadRDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := s.dbs[0].Get("rdb-ttl")
+	if obj == nil || obj.Value != "hello world" {
+		t.Fatalf("rdb-ttl was not restored: %+v", obj)
+	}
+	if actual, _ := s.dbs[0].getExpiry(obj); actual != exp {
+		t.Fatalf("the TTL of rdb-ttl moved from %d to %d", exp, actual)
+	}
+	obj = s.dbs[0].Get("rdb-int")
+	if obj == nil || obj.Value != int64(42) {
+		t.Fatalf("rdb-int was not restored: %+v", obj)
+	}
+	if _, ok := s.dbs[0].getExpiry(obj); ok {
+		t.Fatalf("rdb-int was restored with a TTL")
+	}
+}
+
+func TestLoadCorruptedRDB(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+
+	s.dbs[0].Put("rdb-corrupted", NewObj("value", OBJ_TYPE_STRING, OBJ_ENCODING_RAW))
+	if err := s.rdbSaveSync(); err != nil {
+		t.Fatal(err)
+	}
+	s.dbs[0].Del("rdb-corrupted")
+
+	data, err := os.ReadFile(s.config.RDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		data  []byte
+		error string
+	}{
+		{"checksum", flipByte(data, strings.Index(string(data), "value")), "wrong checksum"},
+		{"truncated", data[:len(data)-3], "unexpected EOF"},
+		{"signature", flipByte(data, 0), "wrong signature"},
+	} {
+		if err := os.WriteFile(s.config.RDBFile, tc.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.LoadRDB(); err == nil || !strings.Contains(err.Error(), tc.error) {
+			t.Fatalf("%s: expected error %q got %v", tc.name, tc.error, err)
+		}
+	}
+}
+
+func flipByte(data []byte, i int) []byte {
+	b := append([]byte{}, data...)
+	b[i] ^= 0xFF
+	return b
+}
+
+func TestParseSaveParams(t *testing.T) {
+	t.Parallel()
+	params, err := parseSaveParams("3600 1 300 100")
+	if err != nil || len(params) != 2 || params[1] != (saveParam{Seconds: 300, Changes: 100}) {
+		t.Fatalf("unexpected save points %+v, %v", params, err)
+	}
+	if params, err := parseSaveParams(""); err != nil || len(params) != 0 {
+		t.Fatalf("unexpected save points %+v, %v", params, err)
+	}
+	for _, s := range []string{"3600", "a 1", "0 1"} {
+		if _, err := parseSaveParams(s); err == nil {
+			t.Fatalf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestCheckRDB(t *testing.T) {
+	t.Parallel()
+	file := filepath.Join(t.TempDir(), "test.rdb")
+	fp, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeRDB(fp, []snapshotEntry{
+		{key: "a", obj: Obj{TypeEncoding: OBJ_TYPE_STRING | OBJ_ENCODING_RAW, Value: "1"}},
+		{key: "b", obj: Obj{TypeEncoding: OBJ_TYPE_STRING | OBJ_ENCODING_RAW, Value: "2"}, expireAt: 1},
+	})
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check, err := CheckRDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.Err != nil || check.Keys["string"] != 2 || check.Expires != 1 {
+		t.Fatalf("unexpected result %+v", check)
+	}
+
+	data, _ := os.ReadFile(file)
+	if err := os.WriteFile(file, data[:len(data)-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if check, _ := CheckRDB(file); check.Err == nil {
+		t.Fatalf("a truncated snapshot is valid")
+	}
+}
+
+func TestStoresSharingADirectory(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	stores := make([]*Store, 2)
+	for i := range stores {
+		s := newTestStore(t)
+		s.config.KeysLimit = 1 << 20
+		s.config.AOFFile = filepath.Join(dir, strconv.Itoa(i)+".aof")
+		s.config.RDBFile = filepath.Join(dir, strconv.Itoa(i)+".rdb")
+		c := s.NewClient(-1)
+		for j := 0; j < 1000; j++ {
+			run(c, "SET "+strconv.Itoa(i)+"-"+strconv.Itoa(j)+" v")
+		}
+		stores[i] = s
+	}
+
+	// the snapshots are written to temporary files at the same time
+	for _, s := range stores {
+		if err := s.rdbSaveBackground(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range stores {
+		s.checkRDBSaveDone(true)
+	}
+	for _, s := range stores {
+		if err := s.rewriteAppendOnlyFileBackground(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range stores {
+		s.checkAOFRewriteDone(true)
+	}
+
+	for i, s := range stores {
+		for _, load := range []func() error{s.LoadRDB, s.LoadAOF} {
+			s.dbs[0].flush()
+			if err := load(); err != nil {
+				t.Fatal(err)
+			}
+			if len(s.dbs[0].dict) != 1000 || s.dbs[0].Get(strconv.Itoa(i)+"-999") == nil {
+				t.Fatalf("store %d restored %d keys instead of its own 1000", i, len(s.dbs[0].dict))
+			}
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 4 {
+		t.Fatalf("the temporary files were left behind: %v", entries)
+	}
+}
@@ -4,6 +4,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/savannahar68/echo-server/config"
 )
 
 // DecodeArrayString simple function to convert byte to array of strings (specifically)
@@ -18,15 +22,48 @@ func DecodeArrayString(data []byte) ([]string, error) {
 		return nil, errors.New("no data")
 	}
 
-	ts := value[0].([]interface{})
+	ts, ok := value[0].([]interface{})
+	if !ok {
+		return nil, &ProtocolError{"expected an array"}
+	}
 	tokens := make([]string, len(ts))
 
 	for i := range tokens {
-		tokens[i] = ts[i].(string)
+		if tokens[i], ok = ts[i].(string); !ok {
+			return nil, &ProtocolError{"expected a bulk string"}
+		}
 	}
 	return tokens, nil
 }
 
+// ErrIncomplete is returned by the decoder when data holds only a prefix
+// of a RESP frame, the caller should keep the bytes and retry once more
+// data has been read from the connection
+var ErrIncomplete = errors.New("incomplete RESP frame")
+
+// ProtocolError is returned by the decoder when data is not valid RESP.
+// The stream can not be resynchronised after it, so the connection that
+// sent the data has to be closed once the error is replied.
+type ProtocolError struct {
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return "ERR Protocol error: " + e.Reason
+}
+
+// maxLineLen is the longest header line (type byte, length or simple
+// value) the decoder waits for before giving up on the frame
+const maxLineLen = 64 * 1024
+
+// maxArrayLen is the largest number of elements accepted in an array
+const maxArrayLen = 1024 * 1024 * 1024
+
+// maxNesting is the deepest level of arrays nested into one another
+const maxNesting = 64
+
+// Decode decodes all the frames present in data. If data ends with a partial
+// frame the values decoded so far are returned along with ErrIncomplete
 func Decode(data []byte) ([]interface{}, error) {
 	if len(data) == 0 {
 		return nil, errors.New("no data")
@@ -46,10 +83,21 @@ func Decode(data []byte) ([]interface{}, error) {
 	return values, nil
 }
 
-// DecodeOne decode only the 1st value
+// DecodeOne decode only the 1st value, the bulk strings are limited to
+// the proto-max-bulk-len set in the config package
 func DecodeOne(data []byte) (interface{}, int, error) {
+	return decoder{maxBulkLen: config.ProtoMaxBulkLen}.decodeOne(data, 0)
+}
+
+// decoder decodes RESP frames, it refuses the bulk strings longer than
+// maxBulkLen. The stores decode with the limit of their configuration.
+type decoder struct {
+	maxBulkLen int
+}
+
+func (d decoder) decodeOne(data []byte, depth int) (interface{}, int, error) {
 	if len(data) == 0 {
-		return nil, 0, errors.New("no data")
+		return nil, 0, ErrIncomplete
 	}
 	switch data[0] {
 	case '+':
@@ -59,29 +107,69 @@ func DecodeOne(data []byte) (interface{}, int, error) {
 		return readInt64(data)
 
 	case '$':
-		return readBulkString(data)
+		return d.readBulkString(data)
 
 	case '*':
-		return readArray(data)
+		return d.readArray(data, depth)
 
 	case '-':
 		return readError(data)
+
+	case '_', ',', '#', '(':
+		return readResp3Simple(data)
+
+	case '=', '!':
+		return d.readResp3Blob(data)
+
+	case '%', '~', '>':
+		return d.readResp3Aggregate(data, depth)
+	}
+
+	return nil, 0, &ProtocolError{fmt.Sprintf("unknown type byte %q", data[0])}
+}
+
+// readLine returns the bytes between the type byte and the first CRLF and
+// the delta to the byte following the CRLF
+func readLine(data []byte) ([]byte, int, error) {
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		if len(data) > maxLineLen {
+			return nil, 0, &ProtocolError{"too big line"}
+		}
+		return nil, 0, ErrIncomplete
+	}
+	if end == 0 || data[end-1] != '\r' {
+		return nil, 0, &ProtocolError{"expected CRLF line terminator"}
 	}
+	line := data[1 : end-1]
+	if bytes.IndexByte(line, '\r') >= 0 {
+		return nil, 0, &ProtocolError{"unexpected CR inside line"}
+	}
+	return line, end + 1, nil
+}
 
-	return nil, 0, nil
+// parseInt parses a signed base 10 integer, unlike strconv it rejects
+// a leading '+' so that every value has a single encoding
+func parseInt(b []byte) (int64, bool) {
+	if len(b) == 0 || b[0] == '+' {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
 }
 
 // readSimpleString reads the RESP encoded simple string and returns
 // string, the delta and the error
 // Example of encoded simple string in RESP "+OK\r\n"
 func readSimpleString(data []byte) (string, int, error) {
-	// pos first value is +
-	pos := 1
-
-	for ; data[pos] != '\r'; pos++ {
+	line, delta, err := readLine(data)
+	if err != nil {
+		return "", 0, err
 	}
-
-	return string(data[1:pos]), pos + 2, nil
+	return string(line), delta, nil
 }
 
 // readError reads the RESP encoded error from data and returns
@@ -95,67 +183,120 @@ func readError(data []byte) (string, int, error) {
 // the int64, the delta and parsing error if any
 // Example of encoded error in RESP ":10\r\n"
 func readInt64(data []byte) (int64, int, error) {
-	pos := 1
-	var value int64 = 0
-	for ; data[pos] != '\r'; pos++ {
-		value = value*10 + int64(data[pos]-'0')
+	line, delta, err := readLine(data)
+	if err != nil {
+		return 0, 0, err
 	}
 
-	return value, pos + 2, nil
+	value, ok := parseInt(line)
+	if !ok {
+		return 0, 0, &ProtocolError{"invalid integer"}
+	}
+	return value, delta, nil
 }
 
 // readBulkString reads the RESP encoded error from data and returns
-// the string, the delta and parsing error if any
+// the string, the delta and parsing error if any. The null bulk
+// string "$-1\r\n" is returned as nil.
 // Example of encoded error in RESP "$4\r\nOkay\r\n"
-func readBulkString(data []byte) (string, int, error) {
-	// first character $
-	pos := 1
-
+func (d decoder) readBulkString(data []byte) (interface{}, int, error) {
 	// reading the length and forwarding the pos by
 	// the length of the integer + the first special character
-	len, delta := readLength(data[pos:])
-	pos += delta
+	length, pos, err := readLength(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if length == -1 {
+		return nil, pos, nil
+	}
+	if length > d.maxBulkLen {
+		return nil, 0, &ProtocolError{"invalid bulk length"}
+	}
+
+	// the payload and its trailing CRLF may not have arrived yet
+	if pos+length+2 > len(data) {
+		return nil, 0, ErrIncomplete
+	}
+	if data[pos+length] != '\r' || data[pos+length+1] != '\n' {
+		return nil, 0, &ProtocolError{"expected CRLF after bulk string"}
+	}
 
-	// reading `len` bytes as string
-	return string(data[pos:(pos + len)]), pos + len + 2, nil
+	// reading `length` bytes as string
+	return string(data[pos:(pos + length)]), pos + length + 2, nil
 }
 
 // readArray reads the RESP encoded error from data and returns
-// the array of elements, the delta and parsing error if any
+// the array of elements, the delta and parsing error if any. The
+// null array "*-1\r\n" is returned as nil.
 // Example of encoded error in RESP "*2\r\n$5\r\nhello\r\n$5\r\nworld\r\n"
-func readArray(data []byte) ([]interface{}, int, error) {
-	pos := 1
-	count, delta := readLength(data[pos:])
-	pos += delta
-
-	elements := make([]interface{}, count)
-	for i := range elements {
-		elem, delta, err := DecodeOne(data[pos:])
+func (d decoder) readArray(data []byte, depth int) (interface{}, int, error) {
+	if depth >= maxNesting {
+		return nil, 0, &ProtocolError{"too many nested arrays"}
+	}
+
+	count, pos, err := readLength(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if count == -1 {
+		return nil, pos, nil
+	}
+	if count > maxArrayLen {
+		return nil, 0, &ProtocolError{"invalid multibulk length"}
+	}
+
+	elements, delta, err := d.readElements(data[pos:], count, depth)
+	if err != nil {
+		return nil, 0, err
+	}
+	return elements, pos + delta, nil
+}
+
+// readElements decodes count consecutive values from data
+func (d decoder) readElements(data []byte, count int, depth int) ([]interface{}, int, error) {
+	// every element takes at least 3 bytes, so do not trust
+	// the announced count for the allocation
+	capacity := count
+	if remaining := len(data) / 3; capacity > remaining {
+		capacity = remaining
+	}
+	elements := make([]interface{}, 0, capacity)
+	pos := 0
+	for i := 0; i < count; i++ {
+		elem, delta, err := d.decodeOne(data[pos:], depth+1)
 		if err != nil {
 			return nil, 0, err
 		}
-		elements[i] = elem
+		elements = append(elements, elem)
 		pos += delta
 	}
 
 	return elements, pos, nil
 }
 
-// readLength reads the lenght of the string until it hits first non digit string
-// returns length of the string and delta (next start point)
-func readLength(data []byte) (int, int) {
-	pos, length := 0, 0
-	for pos = range data {
-		b := data[pos]
-		if !(b >= '0' && b <= '9') {
-			return length, pos + 2
-		}
-		length = length*10 + int(b-'0')
+// readLength reads the length that follows the type byte of a bulk string
+// or an array and returns it along with the delta (next start point)
+func readLength(data []byte) (int, int, error) {
+	line, delta, err := readLine(data)
+	if err != nil {
+		return 0, 0, err
 	}
-	return 0, 0
+
+	length, ok := parseInt(line)
+	if !ok || length < -1 || length > math.MaxInt32 {
+		return 0, 0, &ProtocolError{fmt.Sprintf("invalid length %q", line)}
+	}
+	return int(length), delta, nil
 }
 
 func Encode(value interface{}, isSimple bool) []byte {
+	return EncodeProto(value, isSimple, RESP2)
+}
+
+// EncodeProto encodes value for a client speaking the given protocol
+// version. Values of the RESP3 only types are downgraded to their closest
+// RESP2 counterpart when proto is RESP2.
+func EncodeProto(value interface{}, isSimple bool, proto int) []byte {
 	switch v := value.(type) {
 	case string:
 		if isSimple {
@@ -171,12 +312,26 @@ func Encode(value interface{}, isSimple bool) []byte {
 			buf.Write(encodeString(b))
 		}
 		return []byte(fmt.Sprintf("*%d\r\n%s", len(v), buf.Bytes()))
+	case []interface{}:
+		return encodeAggregate('*', v, proto)
 	case error:
 		return []byte(fmt.Sprintf("-%s\r\n", v))
 	}
-	return []byte{}
+	return encodeResp3(value, proto)
 }
 
 func encodeString(v string) []byte {
 	return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(v), v))
 }
+
+// encodeAggregate encodes the elements of an array like value
+// behind the given type byte and element count
+func encodeAggregate(typ byte, elems []interface{}, proto int) []byte {
+	var b []byte
+	buf := bytes.NewBuffer(b)
+	buf.WriteString(fmt.Sprintf("%c%d\r\n", typ, len(elems)))
+	for _, elem := range elems {
+		buf.Write(EncodeProto(elem, false, proto))
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,224 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// Protocol versions a client can negotiate with HELLO
+const RESP2 int = 2
+const RESP3 int = 3
+
+// KV is a single entry of a Map
+type KV struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// Map is a RESP3 map, RESP2 clients receive it as a flat array of
+// alternating keys and values. A slice is used to keep the order stable.
+type Map []KV
+
+// Set is a RESP3 set, RESP2 clients receive it as an array
+type Set []interface{}
+
+// Push is an out of band RESP3 message, such as a pub/sub notification,
+// RESP2 clients receive it as an array
+type Push []interface{}
+
+// VerbatimString is a RESP3 string along with a 3 characters hint of its
+// format, "txt" or "mkd". RESP2 clients receive it as a bulk string.
+type VerbatimString struct {
+	Format string
+	Text   string
+}
+
+// encodeResp3 encodes the values that only have a native representation
+// in RESP3: nil, float64, bool, *big.Int, VerbatimString, Map, Set and Push
+func encodeResp3(value interface{}, proto int) []byte {
+	if proto < RESP3 {
+		return encodeResp2Fallback(value)
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return []byte("_\r\n")
+	case float64:
+		return []byte(fmt.Sprintf(",%s\r\n", formatDouble(v)))
+	case bool:
+		if v {
+			return []byte("#t\r\n")
+		}
+		return []byte("#f\r\n")
+	case *big.Int:
+		return []byte(fmt.Sprintf("(%s\r\n", v.String()))
+	case VerbatimString:
+		return []byte(fmt.Sprintf("=%d\r\n%s:%s\r\n", len(v.Text)+4, v.Format, v.Text))
+	case Map:
+		var b []byte
+		buf := bytes.NewBuffer(b)
+		buf.WriteString(fmt.Sprintf("%%%d\r\n", len(v)))
+		for _, kv := range v {
+			buf.Write(EncodeProto(kv.Key, false, proto))
+			buf.Write(EncodeProto(kv.Value, false, proto))
+		}
+		return buf.Bytes()
+	case Set:
+		return encodeAggregate('~', v, proto)
+	case Push:
+		return encodeAggregate('>', v, proto)
+	}
+	return []byte{}
+}
+
+func encodeResp2Fallback(value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return RESP_NIL
+	case float64:
+		return encodeString(formatDouble(v))
+	case bool:
+		if v {
+			return RESP_ONE
+		}
+		return RESP_ZERO
+	case *big.Int:
+		return encodeString(v.String())
+	case VerbatimString:
+		return encodeString(v.Text)
+	case Map:
+		elems := make([]interface{}, 0, 2*len(v))
+		for _, kv := range v {
+			elems = append(elems, kv.Key, kv.Value)
+		}
+		return encodeAggregate('*', elems, RESP2)
+	case Set:
+		return encodeAggregate('*', v, RESP2)
+	case Push:
+		return encodeAggregate('*', v, RESP2)
+	}
+	return []byte{}
+}
+
+func formatDouble(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "inf"
+	case math.IsInf(v, -1):
+		return "-inf"
+	case math.IsNaN(v):
+		return "nan"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// readResp3Simple reads the single line RESP3 types and returns the
+// decoded value, the delta and parsing error if any
+// Examples: "_\r\n", ",3.14\r\n", "#t\r\n", "(3492890328409238509324850943850943825024385\r\n"
+func readResp3Simple(data []byte) (interface{}, int, error) {
+	line, delta, err := readLine(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch data[0] {
+	case '_':
+		if len(line) != 0 {
+			return nil, 0, &ProtocolError{"invalid null"}
+		}
+		return nil, delta, nil
+	case ',':
+		switch string(line) {
+		case "inf":
+			return math.Inf(1), delta, nil
+		case "-inf":
+			return math.Inf(-1), delta, nil
+		case "nan":
+			return math.NaN(), delta, nil
+		}
+		v, err := strconv.ParseFloat(string(line), 64)
+		if err != nil {
+			return nil, 0, &ProtocolError{"invalid double"}
+		}
+		return v, delta, nil
+	case '#':
+		switch string(line) {
+		case "t":
+			return true, delta, nil
+		case "f":
+			return false, delta, nil
+		}
+		return nil, 0, &ProtocolError{"invalid boolean"}
+	default:
+		v, ok := new(big.Int).SetString(string(line), 10)
+		if !ok || line[0] == '+' {
+			return nil, 0, &ProtocolError{"invalid big number"}
+		}
+		return v, delta, nil
+	}
+}
+
+// readResp3Blob reads a verbatim string or a blob error, both are length
+// prefixed like bulk strings. Blob errors are returned as string, like the
+// simple errors are.
+// Examples: "=15\r\ntxt:Some string\r\n", "!21\r\nSYNTAX invalid syntax\r\n"
+func (d decoder) readResp3Blob(data []byte) (interface{}, int, error) {
+	value, delta, err := d.readBulkString(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	text, ok := value.(string)
+	if !ok {
+		return nil, 0, &ProtocolError{"invalid blob length"}
+	}
+
+	if data[0] == '!' {
+		return text, delta, nil
+	}
+	if len(text) < 4 || text[3] != ':' {
+		return nil, 0, &ProtocolError{"invalid verbatim string"}
+	}
+	return VerbatimString{Format: text[:3], Text: text[4:]}, delta, nil
+}
+
+// readResp3Aggregate reads a map, a set or a push message
+// Example: "%1\r\n+key\r\n:1\r\n", "~2\r\n:1\r\n:2\r\n", ">2\r\n+message\r\n+hello\r\n"
+func (d decoder) readResp3Aggregate(data []byte, depth int) (interface{}, int, error) {
+	if depth >= maxNesting {
+		return nil, 0, &ProtocolError{"too many nested aggregates"}
+	}
+
+	count, pos, err := readLength(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if count < 0 || count > maxArrayLen {
+		return nil, 0, &ProtocolError{"invalid aggregate length"}
+	}
+
+	n := count
+	if data[0] == '%' {
+		n = 2 * count
+	}
+	elements, delta, err := d.readElements(data[pos:], n, depth)
+	if err != nil {
+		return nil, 0, err
+	}
+	pos += delta
+
+	switch data[0] {
+	case '%':
+		m := make(Map, 0, count)
+		for i := 0; i < len(elements); i += 2 {
+			m = append(m, KV{Key: elements[i], Value: elements[i+1]})
+		}
+		return m, pos, nil
+	case '~':
+		return Set(elements), pos, nil
+	default:
+		return Push(elements), pos, nil
+	}
+}
@@ -1,7 +1,9 @@
 package core_test
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/savannahar68/echo-server/core"
@@ -12,7 +14,7 @@ func TestSimpleStringDecode(t *testing.T) {
 		"+OK\r\n": "OK",
 	}
 	for k, v := range cases {
-		value, _ := core.Decode([]byte(k))
+		value, _, _ := core.DecodeOne([]byte(k))
 		if v != value {
 			_ = fmt.Errorf("actual %+v and expected %+v mismatch", value, v)
 			t.Fail()
@@ -25,7 +27,7 @@ func TestError(t *testing.T) {
 		"-Error message\r\n": "Error message",
 	}
 	for k, v := range cases {
-		value, _ := core.Decode([]byte(k))
+		value, _, _ := core.DecodeOne([]byte(k))
 		if v != value {
 			_ = fmt.Errorf("actual %+v and expected %+v mismatch", value, v)
 			t.Fail()
@@ -39,7 +41,7 @@ func TestInt64(t *testing.T) {
 		":1000\r\n": 1000,
 	}
 	for k, v := range cases {
-		value, _ := core.Decode([]byte(k))
+		value, _, _ := core.DecodeOne([]byte(k))
 		if v != value {
 			_ = fmt.Errorf("actual %+v and expected %+v mismatch", value, v)
 			t.Fail()
@@ -53,7 +55,7 @@ func TestBulkStringDecode(t *testing.T) {
 		"$0\r\n\r\n":      "",
 	}
 	for k, v := range cases {
-		value, _ := core.Decode([]byte(k))
+		value, _, _ := core.DecodeOne([]byte(k))
 		if v != value {
 			_ = fmt.Errorf("actual %+v and expected %+v mismatch", value, v)
 			t.Fail()
@@ -70,7 +72,7 @@ func TestArrayDecode(t *testing.T) {
 		"*2\r\n*3\r\n:1\r\n:2\r\n:3\r\n*2\r\n+Hello\r\n-World\r\n": {[]int64{int64(1), int64(2), int64(3)}, []interface{}{"Hello", "World"}},
 	}
 	for k, v := range cases {
-		value, _ := core.Decode([]byte(k))
+		value, _, _ := core.DecodeOne([]byte(k))
 		array := value.([]interface{})
 		if len(array) != len(v) {
 			_ = fmt.Errorf("actual %+v and expected %+v mismatch", value, v)
@@ -83,3 +85,139 @@ func TestArrayDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestIncompleteDecode(t *testing.T) {
+	frame := "*2\r\n$5\r\nhello\r\n$5\r\nworld\r\n"
+	for i := 0; i < len(frame); i++ {
+		if _, _, err := core.DecodeOne([]byte(frame[:i])); err != core.ErrIncomplete {
+			t.Fatalf("prefix %q: expected ErrIncomplete got %v", frame[:i], err)
+		}
+	}
+	value, delta, err := core.DecodeOne([]byte(frame + "*1"))
+	if err != nil || delta != len(frame) {
+		t.Fatalf("expected full frame of %d bytes, got %d bytes and %v", len(frame), delta, err)
+	}
+	if fmt.Sprintf("%v", value) != "[hello world]" {
+		t.Fatalf("unexpected value %v", value)
+	}
+}
+
+func TestLargeBulkStringDecode(t *testing.T) {
+	payload := strings.Repeat("x", 10000)
+	frame := fmt.Sprintf("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$%d\r\n%s\r\n", len(payload), payload)
+	value, _, err := core.DecodeOne([]byte(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.([]interface{})[2] != payload {
+		t.Fail()
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	cases := []string{
+		"?\r\n",
+		":12a\r\n",
+		":\r\n",
+		"$-2\r\n",
+		"$abc\r\n",
+		"$3\r\nhelloo\r\n",
+		"*-5\r\n",
+		"*1\r\n$1\r\nab\r\n",
+		"+OK\n",
+		"*99999999999\r\n",
+		strings.Repeat("*1\r\n", 100) + ":1\r\n",
+	}
+	for _, k := range cases {
+		_, _, err := core.DecodeOne([]byte(k))
+		var perr *core.ProtocolError
+		if !errors.As(err, &perr) {
+			t.Errorf("%q: expected a protocol error got %v", k, err)
+		}
+	}
+}
+
+func TestNullDecode(t *testing.T) {
+	for _, k := range []string{"$-1\r\n", "*-1\r\n"} {
+		value, delta, err := core.DecodeOne([]byte(k))
+		if err != nil || value != nil || delta != len(k) {
+			t.Errorf("%q: got %v %d %v", k, value, delta, err)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	seeds := []string{
+		"+OK\r\n",
+		"-Error message\r\n",
+		":1000\r\n",
+		"$5\r\nhello\r\n",
+		"$-1\r\n",
+		"*2\r\n$5\r\nhello\r\n$5\r\nworld\r\n",
+		"*2\r\n*3\r\n:1\r\n:2\r\n:3\r\n*2\r\n+Hello\r\n-World\r\n",
+		"%1\r\n+key\r\n~2\r\n,1.5\r\n#f\r\n",
+		">2\r\n=8\r\ntxt:push\r\n(12\r\n",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, delta, err := core.DecodeOne(data)
+		if err != nil {
+			var perr *core.ProtocolError
+			if err != core.ErrIncomplete && !errors.As(err, &perr) {
+				t.Fatalf("unexpected error type %T: %v", err, err)
+			}
+			return
+		}
+		if delta <= 0 || delta > len(data) {
+			t.Fatalf("delta %d out of range for %d bytes", delta, len(data))
+		}
+		// the frame must decode on its own, without the trailing bytes
+		if _, d, err := core.DecodeOne(data[:delta]); err != nil || d != delta {
+			t.Fatalf("frame %q did not decode on its own: %d %v", data[:delta], d, err)
+		}
+	})
+}
+
+func TestResp3Decode(t *testing.T) {
+	cases := map[string]string{
+		"_\r\n":     "<nil>",
+		",3.14\r\n": "3.14",
+		",-inf\r\n": "-Inf",
+		"#t\r\n":    "true",
+		"(3492890328409238509324850943850943825024385\r\n": "3492890328409238509324850943850943825024385",
+		"=15\r\ntxt:Some string\r\n":                       "{txt Some string}",
+		"!21\r\nSYNTAX invalid syntax\r\n":                 "SYNTAX invalid syntax",
+		"%2\r\n+first\r\n:1\r\n+second\r\n:2\r\n":          "[{first 1} {second 2}]",
+		"~2\r\n:1\r\n$1\r\na\r\n":                          "[1 a]",
+		">2\r\n+message\r\n+hello\r\n":                     "[message hello]",
+	}
+	for k, v := range cases {
+		value, delta, err := core.DecodeOne([]byte(k))
+		if err != nil || delta != len(k) {
+			t.Errorf("%q: got %d %v", k, delta, err)
+			continue
+		}
+		if fmt.Sprintf("%v", value) != v {
+			t.Errorf("%q: actual %v and expected %v mismatch", k, value, v)
+		}
+	}
+}
+
+func TestResp3Encode(t *testing.T) {
+	value := core.Map{
+		{Key: "proto", Value: 3},
+		{Key: "float", Value: 1.5},
+		{Key: "set", Value: core.Set{true, nil}},
+	}
+	cases := map[int]string{
+		core.RESP2: "*6\r\n$5\r\nproto\r\n:3\r\n$5\r\nfloat\r\n$3\r\n1.5\r\n$3\r\nset\r\n*2\r\n:1\r\n$-1\r\n",
+		core.RESP3: "%3\r\n$5\r\nproto\r\n:3\r\n$5\r\nfloat\r\n,1.5\r\n$3\r\nset\r\n~2\r\n#t\r\n_\r\n",
+	}
+	for proto, expected := range cases {
+		if actual := string(core.EncodeProto(value, false, proto)); actual != expected {
+			t.Errorf("RESP%d: actual %q and expected %q mismatch", proto, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"hash/maphash"
+	"math/bits"
+)
+
+// minIndexSize is the smallest number of buckets of a key index
+const minIndexSize = 4
+
+// indexSeed hashes the keys of all the indexes, a cursor is only valid
+// for the process that returned it
+var indexSeed = maphash.MakeSeed()
+
+// keyIndex places the keys of a database in a power of two number of
+// buckets by hash. Go maps hide their buckets, the index gives SCAN a
+// stable order to walk while the keyspace changes between two calls.
+type keyIndex struct {
+	buckets [][]string
+	count   int
+}
+
+func newKeyIndex() keyIndex {
+	return keyIndex{buckets: make([][]string, minIndexSize)}
+}
+
+func (ix *keyIndex) bucket(key string) uint64 {
+	return maphash.String(indexSeed, key) & uint64(len(ix.buckets)-1)
+}
+
+// add indexes key, it must not be indexed already
+func (ix *keyIndex) add(key string) {
+	if ix.count >= len(ix.buckets) {
+		ix.resize(2 * len(ix.buckets))
+	}
+	b := ix.bucket(key)
+	ix.buckets[b] = append(ix.buckets[b], key)
+	ix.count++
+}
+
+// remove removes key from the index, it must be indexed
+func (ix *keyIndex) remove(key string) {
+	b := ix.bucket(key)
+	keys := ix.buckets[b]
+	for i := range keys {
+		if keys[i] == key {
+			keys[i] = keys[len(keys)-1]
+			ix.buckets[b] = keys[:len(keys)-1]
+			break
+		}
+	}
+	ix.count--
+	if len(ix.buckets) > minIndexSize && ix.count < len(ix.buckets)/8 {
+		ix.resize(len(ix.buckets) / 2)
+	}
+}
+
+// resize moves the keys to size buckets
+func (ix *keyIndex) resize(size int) {
+	old := ix.buckets
+	ix.buckets = make([][]string, size)
+	for _, keys := range old {
+		for _, key := range keys {
+			b := ix.bucket(key)
+			ix.buckets[b] = append(ix.buckets[b], key)
+		}
+	}
+}
+
+// scan calls fn for the keys of the bucket at cursor and returns the
+// cursor of the next bucket, 0 once all of them were visited. The cursor
+// is incremented from its most significant bit: the buckets already
+// visited map to buckets below the cursor whatever the number of
+// buckets, so that a key indexed for the whole iteration is visited at
+// least once even when the index is resized between two calls.
+func (ix *keyIndex) scan(cursor uint64, fn func(key string)) uint64 {
+	mask := uint64(len(ix.buckets) - 1)
+	for _, key := range ix.buckets[cursor&mask] {
+		fn(key)
+	}
+
+	// increment the bits of the cursor covered by the mask, reversed
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
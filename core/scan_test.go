@@ -0,0 +1,165 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGlobMatch(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h*llo", "hellox", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"user:*:name", "user:42:name", true},
+		{"user:*:name", "user:42:email", false},
+		{"**a", "bba", true},
+		{"[", "a", false},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbx", false},
+		{"a*b*", "ab", true},
+		{"*[0-9]", "key9", true},
+		{"*\\*", "a*", true},
+		{"*\\*", "ab", false},
+	} {
+		if actual := globMatch(tc.pattern, tc.s); actual != tc.match {
+			t.Errorf("%q %q: actual %v and expected %v mismatch", tc.pattern, tc.s, actual, tc.match)
+		}
+	}
+
+	// the stars must not be retried against each other
+	start := time.Now()
+	if globMatch(strings.Repeat("*a", 12)+"b", strings.Repeat("a", 60)) {
+		t.Fatalf("unexpected match")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("matching took %v", elapsed)
+	}
+}
+
+func TestKeysAndScanCommands(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	c := s.NewClient(-1)
+
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		{"KEYS *", "*0\r\n"},
+		{"SCAN 0", "*2\r\n$1\r\n0\r\n*0\r\n"},
+		{"SCAN x", "-ERR invalid cursor\r\n"},
+		{"SCAN 0 COUNT 0", "-ERR syntax error\r\n"},
+		{"SCAN 0 COUNT x", "-ERR value is not an integer or out of range\r\n"},
+		{"SCAN 0 MATCH", "-ERR syntax error\r\n"},
+		{"SCAN 0 NOPE x", "-ERR syntax error\r\n"},
+		{"SET user:1 a", "+OK\r\n"},
+		{"SET other b", "+OK\r\n"},
+		{"KEYS user:*", "*1\r\n$6\r\nuser:1\r\n"},
+		{"SCAN 0 MATCH user:* COUNT 100", "*2\r\n$1\r\n0\r\n*1\r\n$6\r\nuser:1\r\n"},
+		{"SCAN 0 TYPE hash COUNT 100", "*2\r\n$1\r\n0\r\n*0\r\n"},
+		{"SCAN 0 MATCH user:* COUNT 1000000000000000000", "*2\r\n$1\r\n0\r\n*1\r\n$6\r\nuser:1\r\n"},
+		{"PEXPIREAT other 9999999999999", ":1\r\n"},
+	} {
+		if actual := run(c, tc.line); actual != tc.expected {
+			t.Fatalf("%s: actual %q and expected %q mismatch", tc.line, actual, tc.expected)
+		}
+	}
+
+	// the expired keys are skipped
+	s.dbs[0].expires[s.dbs[0].dict["other"]] = 1
+	if reply := run(c, "KEYS *"); reply != "*1\r\n$6\r\nuser:1\r\n" {
+		t.Fatalf("unexpected keys %q", reply)
+	}
+	if reply := run(c, "SCAN 0 TYPE STRING COUNT 100"); reply != "*2\r\n$1\r\n0\r\n*1\r\n$6\r\nuser:1\r\n" {
+		t.Fatalf("unexpected scan %q", reply)
+	}
+	if s.dbs[0].index.count != 1 {
+		t.Fatalf("the index counts %d keys", s.dbs[0].index.count)
+	}
+}
+
+// scanAll runs a full SCAN iteration and calls between after each call
+func scanAll(t *testing.T, c *Client, between func(i int)) map[string]int {
+	seen := make(map[string]int)
+	cursor := "0"
+	for i := 0; ; i++ {
+		values, err := Decode([]byte(run(c, "SCAN "+cursor+" COUNT 5")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := values[0].([]interface{})
+		for _, key := range reply[1].([]interface{}) {
+			seen[key.(string)]++
+		}
+		if cursor = reply[0].(string); cursor == "0" {
+			return seen
+		}
+		between(i)
+	}
+}
+
+func TestScanWhileTheKeyspaceChanges(t *testing.T) {
+	t.Parallel()
+	s := newTestStore(t)
+	s.config.KeysLimit = 1 << 20
+	c := s.NewClient(-1)
+
+	for i := 0; i < 100; i++ {
+		run(c, fmt.Sprintf("SET stable%d v", i))
+	}
+
+	for _, tc := range []struct {
+		name    string
+		between func(i int)
+	}{
+		// the index grows several times during the iteration
+		{"grow", func(i int) {
+			for j := 0; j < 50 && i < 20; j++ {
+				run(c, fmt.Sprintf("SET grow%d-%d v", i, j))
+			}
+		}},
+		// and shrinks back
+		{"shrink", func(i int) {
+			keys := make([]string, 0)
+			for key := range s.dbs[0].dict {
+				if !strings.HasPrefix(key, "stable") {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for j := 0; j < 200 && j < len(keys); j++ {
+				s.dbs[0].Del(keys[j])
+			}
+		}},
+	} {
+		seen := scanAll(t, c, tc.between)
+		for i := 0; i < 100; i++ {
+			if seen[fmt.Sprintf("stable%d", i)] == 0 {
+				t.Fatalf("%s: stable%d was not returned", tc.name, i)
+			}
+		}
+	}
+	if n := len(s.dbs[0].index.buckets); n > 512 {
+		t.Fatalf("the index did not shrink: %d buckets", n)
+	}
+}
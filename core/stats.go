@@ -1,7 +1,30 @@
 package core
 
-var KeyspaceStat [4]map[string]int
+import "time"
 
-func UpdateDBStat(num int, metric string, value int) {
-	KeyspaceStat[num][metric] = value
+// DBStat is what INFO keyspace reports about a database
+type DBStat struct {
+	Keys    int
+	Expires int
+	// AvgTTL is the average time to live in milliseconds of the keys
+	// with an expiry
+	AvgTTL int64
+}
+
+// Stat computes the keyspace statistics of db
+func (db *DB) Stat() DBStat {
+	stat := DBStat{Keys: len(db.dict), Expires: len(db.expires)}
+	if stat.Expires == 0 {
+		return stat
+	}
+
+	now := uint64(time.Now().UnixMilli())
+	var total uint64
+	for _, exp := range db.expires {
+		if exp > now {
+			total += exp - now
+		}
+	}
+	stat.AvgTTL = int64(total / uint64(stat.Expires))
+	return stat
 }
@@ -1,69 +1,278 @@
 package core
 
 import (
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/savannahar68/echo-server/config"
 )
 
-var store map[string]*Obj
-var expires map[*Obj]uint64
+// DB is a logical database, an independent keyspace the clients switch
+// between with SELECT
+type DB struct {
+	ID      int
+	store   *Store
+	dict    map[string]*Obj
+	expires map[*Obj]uint64
+	// index orders the keys of dict for SCAN
+	index keyIndex
+}
+
+func newDB(s *Store, id int) *DB {
+	return &DB{
+		ID:      id,
+		store:   s,
+		dict:    make(map[string]*Obj),
+		expires: make(map[*Obj]uint64),
+		index:   newKeyIndex(),
+	}
+}
+
+// Config is the configuration of a store
+type Config struct {
+	// Databases is the number of logical databases
+	Databases int
+	// KeysLimit is the number of keys past which keys are evicted
+	// according to EvictionStrategy
+	KeysLimit        int
+	EvictionStrategy string
+	EvictionRatio    float64
+
+	AppendOnly        bool
+	AppendFsync       string
+	AOFFile           string
+	AOFUseRDBPreamble bool
+	AOFLoadTruncated  bool
+	RDBFile           string
+	// Save lists the snapshot save points as pairs of "<seconds> <changes>"
+	Save string
+
+	// ProtoMaxBulkLen is the largest bulk string, in bytes, accepted from
+	// the clients and the files loaded
+	ProtoMaxBulkLen int
+	// ClientQueryBufferLimit caps the unparsed bytes buffered for a client
+	ClientQueryBufferLimit int
+}
+
+// DefaultConfig returns the configuration set in the config package,
+// usually from the command line
+func DefaultConfig() Config {
+	return Config{
+		Databases:         config.Databases,
+		KeysLimit:         config.KeysLimit,
+		EvictionStrategy:  config.EvictionStrategy,
+		EvictionRatio:     config.EvictionRatio,
+		AppendOnly:        config.AppendOnly,
+		AppendFsync:       config.AppendFsync,
+		AOFFile:           config.AOFFile,
+		AOFUseRDBPreamble: config.AOFUseRDBPreamble,
+		AOFLoadTruncated:  config.AOFLoadTruncated,
+		RDBFile:           config.RDBFile,
+		Save:              config.Save,
+
+		ProtoMaxBulkLen:        config.ProtoMaxBulkLen,
+		ClientQueryBufferLimit: config.ClientQueryBufferLimit,
+	}
+}
+
+// Store is an instance of the engine: its databases, eviction pool and
+// persistence. Stores are independent of each other.
+type Store struct {
+	// mu serializes the commands of the event loop and of the Go API
+	mu sync.Mutex
 
-func init() {
-	store = make(map[string]*Obj)
-	expires = make(map[*Obj]uint64)
+	config Config
+	dbs    []*DB
+	ePool  *EvictionPool
+
+	// dirty counts the changes made to the keyspace, a write command is
+	// logged only when it changed something
+	dirty int64
+	// loading is set while the dataset is being restored from disk, the
+	// replayed commands must not be logged again
+	loading bool
+
+	aof aofState
+	rdb rdbState
 }
 
-func SetExpiry(obj *Obj, exDurationMs int64) {
-	expires[obj] = uint64(time.Now().UnixMilli() + exDurationMs)
+// NewStore returns an empty store, Startup loads its dataset from disk
+func NewStore(cfg Config) (*Store, error) {
+	if cfg.Databases < 1 {
+		return nil, fmt.Errorf("invalid number of databases %d", cfg.Databases)
+	}
+	switch cfg.AppendFsync {
+	case AOF_FSYNC_ALWAYS, AOF_FSYNC_EVERYSEC, AOF_FSYNC_NO:
+	default:
+		return nil, fmt.Errorf("invalid appendfsync policy %q", cfg.AppendFsync)
+	}
+	if cfg.ProtoMaxBulkLen < 1 {
+		return nil, fmt.Errorf("invalid proto-max-bulk-len %d", cfg.ProtoMaxBulkLen)
+	}
+	if cfg.ClientQueryBufferLimit < 1 {
+		return nil, fmt.Errorf("invalid client query buffer limit %d", cfg.ClientQueryBufferLimit)
+	}
+	saveParams, err := parseSaveParams(cfg.Save)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{config: cfg, ePool: newEvictionPool(0)}
+	s.dbs = make([]*DB, cfg.Databases)
+	for i := range s.dbs {
+		s.dbs[i] = newDB(s, i)
+	}
+
+	now := time.Now()
+	s.aof.lastFsync = now
+	s.aof.selectedDB = -1
+	s.aof.lastWriteStatus = "ok"
+	s.aof.rewrite.lastStatus = "ok"
+	s.aof.rewrite.lastDuration = -1
+	s.rdb.lastStatus = "ok"
+	s.rdb.lastDuration = -1
+	s.rdb.lastSave = now
+	s.rdb.saveParams = saveParams
+	return s, nil
 }
 
-func NewObj(value interface{}, exDurationMs int64, oType uint8, oEnc uint8) *Obj {
-	obj := &Obj{
+// decoder returns a decoder enforcing the limits of the configuration
+func (s *Store) decoder() decoder {
+	return decoder{maxBulkLen: s.config.ProtoMaxBulkLen}
+}
+
+// totalKeys is the number of keys across all the databases
+func (s *Store) totalKeys() int {
+	n := 0
+	for _, db := range s.dbs {
+		n += len(db.dict)
+	}
+	return n
+}
+
+func (db *DB) SetExpiry(obj *Obj, exDurationMs int64) {
+	db.setExpireAt(obj, uint64(time.Now().UnixMilli()+exDurationMs))
+}
+
+// setExpireAt sets the expiry of obj to the absolute unix time expireAt in milliseconds
+func (db *DB) setExpireAt(obj *Obj, expireAt uint64) {
+	db.expires[obj] = expireAt
+	db.store.dirty++
+}
+
+func NewObj(value interface{}, oType uint8, oEnc uint8) *Obj {
+	return &Obj{
 		TypeEncoding:   oType | oEnc,
 		Value:          value,
 		LastAccessedAt: getCurrentClock(),
 	}
-	if exDurationMs > 0 {
-		SetExpiry(obj, exDurationMs)
-	}
-	return obj
 }
 
 func getCurrentClock() uint32 {
 	return uint32(time.Now().UnixMilli()) & 0xFFFFF
 }
 
-func Put(key string, obj *Obj) {
-	if len(store) >= config.KeysLimit {
-		Evict()
+// Put sets key to obj, dropping the TTL of the value it replaces
+func (db *DB) Put(key string, obj *Obj) {
+	db.put(key, obj, false)
+}
+
+// put sets key to obj, the TTL of the value it replaces is moved to obj
+// when keepTTL is set
+func (db *DB) put(key string, obj *Obj, keepTTL bool) {
+	old, exists := db.dict[key]
+	if !exists && db.store.totalKeys() >= db.store.config.KeysLimit {
+		db.store.Evict()
 	}
-	obj.LastAccessedAt = getCurrentClock()
-	store[key] = obj
-	if KeyspaceStat[0] == nil {
-		KeyspaceStat[0] = make(map[string]int)
+	if exists {
+		exp, hasExpiry := db.expires[old]
+		delete(db.expires, old)
+		if keepTTL && hasExpiry {
+			db.expires[obj] = exp
+		}
+	} else {
+		db.index.add(key)
 	}
-	KeyspaceStat[0]["keys"]++
+	obj.LastAccessedAt = getCurrentClock()
+	db.dict[key] = obj
+	db.store.dirty++
 }
 
-func Get(key string) *Obj {
-	v := store[key]
+// setString replaces the value of the string obj in place, keeping its
+// TTL, its encoding is deduced again from value
+func (db *DB) setString(obj *Obj, value string) {
+	oType, oEnc := DeduceTypeEncoding(value)
+	obj.TypeEncoding = oType | oEnc
+	obj.Value = stringObjValue(value, oEnc)
+	obj.LastAccessedAt = getCurrentClock()
+	db.store.dirty++
+}
+
+func (db *DB) Get(key string) *Obj {
+	v := db.dict[key]
 	if v != nil {
-		if HasExpired(v) {
-			Del(key)
+		if db.HasExpired(v) {
+			db.Del(key)
 			return nil
 		}
+		v.LastAccessedAt = getCurrentClock()
 	}
-	v.LastAccessedAt = getCurrentClock()
 	return v
 }
 
-func Del(key string) bool {
-	if obj, ok := store[key]; ok {
-		delete(store, key)
-		delete(expires, obj)
-		KeyspaceStat[0]["keys"]--
+func (db *DB) Del(key string) bool {
+	if obj, ok := db.dict[key]; ok {
+		delete(db.dict, key)
+		delete(db.expires, obj)
+		db.index.remove(key)
+		db.store.dirty++
 		return true
 	}
 	return false
 }
+
+// flush deletes all the keys of db and returns how many there were
+func (db *DB) flush() int {
+	n := len(db.dict)
+	db.dict = make(map[string]*Obj)
+	db.expires = make(map[*Obj]uint64)
+	db.index = newKeyIndex()
+	db.store.dirty += int64(n)
+	return n
+}
+
+// swap exchanges the keys of db and other, the clients that selected
+// one of them see the keys of the other from now on
+func (db *DB) swap(other *DB) {
+	db.dict, other.dict = other.dict, db.dict
+	db.expires, other.expires = other.expires, db.expires
+	db.index, other.index = other.index, db.index
+	db.store.dirty++
+}
+
+// snapshotEntry is a point in time copy of a key
+type snapshotEntry struct {
+	db  int
+	key string
+	obj Obj
+	// expireAt is the absolute expiry in unix milliseconds, 0 for none
+	expireAt uint64
+}
+
+// snapshotKeyspace copies the keys that have not expired yet, grouped by
+// database, the copy can be persisted off the event loop while the
+// keyspace keeps changing
+func (s *Store) snapshotKeyspace() []snapshotEntry {
+	entries := make([]snapshotEntry, 0, s.totalKeys())
+	for _, db := range s.dbs {
+		for k, obj := range db.dict {
+			if db.HasExpired(obj) {
+				continue
+			}
+			exp, _ := db.getExpiry(obj)
+			entries = append(entries, snapshotEntry{db: db.ID, key: k, obj: *obj, expireAt: exp})
+		}
+	}
+	return entries
+}
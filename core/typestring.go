@@ -2,10 +2,13 @@ package core
 
 import "strconv"
 
+// DeduceTypeEncoding returns the type and encoding of the string value.
+// Only the canonical form of an integer is encoded as one, "007" or "+7"
+// would not read back the same.
 func DeduceTypeEncoding(value string) (uint8, uint8) {
 	oType := OBJ_TYPE_STRING
 
-	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil && strconv.FormatInt(i, 10) == value {
 		return oType, OBJ_ENCODING_INT
 	}
 	if len(value) < 44 {
@@ -14,3 +17,27 @@ func DeduceTypeEncoding(value string) (uint8, uint8) {
 
 	return oType, OBJ_ENCODING_RAW
 }
+
+// stringObjValue returns the Value of a string object with the encoding
+// oEnc holding value, the integers are stored as int64
+func stringObjValue(value string, oEnc uint8) interface{} {
+	if oEnc == OBJ_ENCODING_INT {
+		i, _ := strconv.ParseInt(value, 10, 64)
+		return i
+	}
+	return value
+}
+
+// newStringObj returns a string object holding value
+func newStringObj(value string) *Obj {
+	oType, oEnc := DeduceTypeEncoding(value)
+	return NewObj(stringObjValue(value, oEnc), oType, oEnc)
+}
+
+// getString returns the value of the string object obj
+func getString(obj *Obj) string {
+	if i, ok := obj.Value.(int64); ok {
+		return strconv.FormatInt(i, 10)
+	}
+	return obj.Value.(string)
+}
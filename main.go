@@ -1,20 +1,31 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"net"
 	"os"
 	"os/signal"
-	"sync"
+	"strconv"
 	"syscall"
 
 	"github.com/savannahar68/echo-server/config"
+	"github.com/savannahar68/echo-server/core"
 	"github.com/savannahar68/echo-server/server"
 )
 
 func setupFlags() {
 	flag.StringVar(&config.Host, "host", "0.0.0.0", "host for the dice server")
 	flag.IntVar(&config.Port, "port", 7379, "port for the dice server")
+	flag.IntVar(&config.Databases, "databases", config.Databases, "number of logical databases")
+	flag.BoolVar(&config.AppendOnly, "appendonly", config.AppendOnly, "log every write command to the append only file")
+	flag.StringVar(&config.AppendFsync, "appendfsync", config.AppendFsync, "fsync policy of the append only file: always, everysec or no")
+	flag.BoolVar(&config.AOFUseRDBPreamble, "aof-use-rdb-preamble", config.AOFUseRDBPreamble, "start the rewritten append only file with a binary snapshot of the dataset")
+	flag.BoolVar(&config.AOFLoadTruncated, "aof-load-truncated", config.AOFLoadTruncated, "truncate a partial command at the end of the append only file instead of refusing to start")
+	flag.StringVar(&config.RDBFile, "rdbfile", config.RDBFile, "path of the binary snapshot of the dataset")
+	flag.StringVar(&config.Save, "save", config.Save, "snapshot save points as \"<seconds> <changes>\" pairs, empty to disable")
+	flag.IntVar(&config.ProtoMaxBulkLen, "proto-max-bulk-len", config.ProtoMaxBulkLen, "max size in bytes of a bulk string sent by a client")
 	flag.Parse()
 }
 
@@ -22,13 +33,32 @@ func main() {
 	setupFlags()
 	log.Println("rolling the dice 🎲")
 
+	store, err := core.NewStore(core.DefaultConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := store.Startup(); err != nil {
+		log.Fatal(err)
+	}
+
+	srv, err := server.New(server.Options{
+		Addr:  net.JoinHostPort(config.Host, strconv.Itoa(config.Port)),
+		Store: store,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	var sigs chan os.Signal = make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	var wg sync.WaitGroup
-	wg.Add(2)
 
-	go server.RunAsyncTCPServer(&wg)
-	go server.WaitForSignal(&wg, sigs)
+	if err := srv.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	<-sigs
 
-	wg.Wait()
+	// Wait for the command being executed and then shut down
+	if err := srv.Shutdown(context.Background()); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -1,196 +1,143 @@
 package server
 
 import (
+	"errors"
 	"io"
 	"log"
-	"net"
-	"os"
-	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/savannahar68/echo-server/config"
 	"github.com/savannahar68/echo-server/core"
 )
 
-var conClients = 0
 var cronFrequency = 1 * time.Second
-var lastCronExecutionTime = time.Now()
 
 const EngineStatus_WAITING int32 = 1 << 1
 const EngineStatus_BUSY int32 = 1 << 2
 const EngineStatus_SHUTTING_DOWN int32 = 1 << 3
 const EngineStatus_TRANSACTION int32 = 1 << 4
 
-var eStatus int32 = EngineStatus_WAITING
+// eventLoop serves the clients until the server shuts down, then
+// releases the sockets and shuts the store down
+func (s *Server) eventLoop() {
+	defer close(s.done)
+	defer s.release()
 
-var connectedClients map[int]*core.Client
+	readyFds := make([]int, s.opts.MaxClients)
 
-func init() {
-	connectedClients = make(map[int]*core.Client)
-}
-
-func RunAsyncTCPServer(wg *sync.WaitGroup) {
-	defer wg.Done()
-	defer func() {
-		atomic.StoreInt32(&eStatus, EngineStatus_SHUTTING_DOWN)
-	}()
-
-	log.Println("Starting an asynchronous server on ", config.Host, config.Port)
-	maxClients := 20000
+	for atomic.LoadInt32(&s.status) != EngineStatus_SHUTTING_DOWN {
 
-	events := make([]syscall.Kevent_t, maxClients)
-
-	// create a socket
-	serverFd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
-
-	if err != nil {
-		println("Err", err)
-		panic(err)
-	}
+		if time.Now().After(s.lastCron.Add(cronFrequency)) {
+			s.store.Cron()
+			s.lastCron = time.Now()
+		}
 
-	defer func(fd int) {
-		err := syscall.Close(fd)
+		// wake up at least once per cron cycle even when no client is active
+		nevents, err := s.p.Wait(readyFds, cronFrequency)
 		if err != nil {
+			continue
+		}
 
+		if !atomic.CompareAndSwapInt32(&s.status, EngineStatus_WAITING, EngineStatus_BUSY) {
+			return
 		}
-	}(serverFd)
 
-	// set the server socket as non-blocking
-	err = syscall.SetNonblock(serverFd, true)
-	if err != nil {
-		panic(err)
-	}
+		for i := 0; i < nevents; i++ {
+			switch readyFds[i] {
+			case s.fd:
+				// accept incoming events
+				s.acceptClient()
+			case s.wakeR:
+				// the loop condition checks why it was woken up
+				var buf [64]byte
+				syscall.Read(s.wakeR, buf[:])
+			default:
+				s.serveClient(readyFds[i])
+			}
+		}
 
-	// Bind the IP and Port
-	ip4 := net.ParseIP(config.Host)
-	err = syscall.Bind(serverFd, &syscall.SockaddrInet4{
-		Port: config.Port,
-		Addr: [4]byte{ip4[0], ip4[1], ip4[2], ip4[3]},
-	})
-	if err != nil {
-		panic(err)
+		// Waiting for next event
+		atomic.CompareAndSwapInt32(&s.status, EngineStatus_BUSY, EngineStatus_WAITING)
 	}
+}
 
-	// start listening on socket
-	err = syscall.Listen(serverFd, maxClients)
-	if err != nil {
-		panic(err)
+// release disconnects the clients, closes the sockets of the server and
+// shuts the store down
+func (s *Server) release() {
+	for fd := range s.clients {
+		s.closeClient(fd)
+	}
+	s.p.Close()
+	syscall.Close(s.fd)
+	if s.opts.Network == "unix" {
+		syscall.Unlink(s.opts.Addr)
 	}
 
-	// Async io - event loop start
+	s.mu.Lock()
+	s.closed = true
+	syscall.Close(s.wakeR)
+	syscall.Close(s.wakeW)
+	s.mu.Unlock()
+
+	s.store.Shutdown()
+}
 
-	// create KQueue
-	kqFd, err := syscall.Kqueue()
+// acceptClient accepts the pending connection on the server socket
+// and registers it with the poller as a client of the store
+func (s *Server) acceptClient() {
+	fd, _, err := syscall.Accept(s.fd)
 	if err != nil {
-		log.Println("Error creating Kqueue descriptor!")
-		panic(err)
+		log.Println("err", err)
+		return
 	}
-	defer syscall.Close(kqFd)
 
-	socketServerEvent := syscall.Kevent_t{
-		Ident:  uint64(serverFd),
-		Filter: syscall.EVFILT_READ,
-		Flags:  syscall.EV_ADD | syscall.EV_ENABLE,
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		log.Println("err", err)
+		syscall.Close(fd)
+		return
 	}
 
-	// Listen to read events on the Server itself
-	if changeEventRegistered, err := syscall.Kevent(kqFd, []syscall.Kevent_t{socketServerEvent}, nil, nil); err != nil || changeEventRegistered == -1 {
-		panic(err)
+	// add this connection to be monitored
+	if err := s.p.Add(fd); err != nil {
+		log.Println("err", err)
+		syscall.Close(fd)
+		return
 	}
 
-	for atomic.LoadInt32(&eStatus) != EngineStatus_SHUTTING_DOWN {
-
-		// Active delete of expired keys
-		if time.Now().After(lastCronExecutionTime.Add(cronFrequency)) {
-			core.DeleteExpiredKeys()
-			lastCronExecutionTime = time.Now()
-		}
+	s.clients[fd] = s.store.NewClient(fd)
+}
 
-		nevents, err := syscall.Kevent(kqFd, nil, events, nil)
-		if err != nil {
-			continue
-		}
+// serveClient reads the commands available on fd and responds to them
+func (s *Server) serveClient(fd int) {
+	comm := s.clients[fd]
+	if comm == nil {
+		return
+	}
 
-		if !atomic.CompareAndSwapInt32(&eStatus, EngineStatus_WAITING, EngineStatus_BUSY) {
-			switch eStatus {
-			case EngineStatus_SHUTTING_DOWN:
-				return
-			}
+	cmds, err := readCommands(comm)
+	if len(cmds) > 0 {
+		log.Println("command", cmds)
+		respond(cmds, comm)
+	}
+	if err != nil {
+		// tell the client why it is being disconnected
+		var perr *core.ProtocolError
+		if errors.As(err, &perr) {
+			respondError(perr, comm)
 		}
-
-		for i := 0; i < nevents; i++ {
-
-			// accept incoming events
-			if events[i].Ident == uint64(serverFd) {
-				fd, _, err := syscall.Accept(serverFd)
-				if err != nil {
-					panic(err)
-				}
-
-				connectedClients[fd] = core.NewClient(fd)
-
-				conClients++
-				err = syscall.SetNonblock(fd, true)
-				if err != nil {
-					return
-				}
-
-				// add this TCP connection to be monitored
-				socketClientEvent := syscall.Kevent_t{
-					Ident:  uint64(fd),
-					Filter: syscall.EVFILT_READ,
-					Flags:  syscall.EV_ADD | syscall.EV_ENABLE,
-				}
-
-				if changeEventRegistered, err := syscall.Kevent(kqFd, []syscall.Kevent_t{socketClientEvent}, nil, nil); err != nil || changeEventRegistered == -1 {
-					panic(err)
-				}
-			} else {
-				comm := connectedClients[int(events[i].Ident)]
-				if comm == nil {
-					return
-				}
-				cmds, err := readCommands(comm)
-				if err != nil {
-					err := syscall.Close(int(events[i].Ident))
-					delete(connectedClients, int(events[i].Ident))
-
-					if err != nil {
-						return
-					}
-					conClients -= 1
-					if err == io.EOF {
-						break
-					}
-					log.Println("err", err)
-				} else {
-					log.Println("command", cmds)
-					respond(cmds, comm)
-				}
-			}
-
+		s.closeClient(fd)
+		if err != io.EOF {
+			log.Println("err", err)
 		}
-
-		// Waiting for next event
-		atomic.StoreInt32(&eStatus, EngineStatus_WAITING)
 	}
-
 }
 
-func WaitForSignal(wg *sync.WaitGroup, sigs chan os.Signal) {
-	defer wg.Done()
-	<-sigs
-
-	// Wait for existing command and then shut down
-
-	// If server is busy wait
-	for atomic.LoadInt32(&eStatus) == EngineStatus_BUSY {
+// closeClient stops watching fd and releases the client attached to it
+func (s *Server) closeClient(fd int) {
+	s.p.Remove(fd)
+	if err := syscall.Close(fd); err != nil {
+		log.Println("err", err)
 	}
-
-	atomic.StoreInt32(&eStatus, EngineStatus_SHUTTING_DOWN)
-
-	core.Shutdown()
-	os.Exit(0)
+	delete(s.clients, fd)
 }
@@ -0,0 +1,17 @@
+package server
+
+import "time"
+
+// poller is the readiness notification backend of the event loop.
+// epoll is used on Linux and kqueue on Darwin and the BSDs, the
+// implementation is picked at compile time through build tags.
+type poller interface {
+	// Add starts watching fd for read events
+	Add(fd int) error
+	// Remove stops watching fd, it must be called before closing fd
+	Remove(fd int) error
+	// Wait blocks until at least one watched fd is readable or timeout
+	// expires. The readable fds are written into fds and their count is returned.
+	Wait(fds []int, timeout time.Duration) (int, error)
+	Close() error
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package server
+
+import (
+	"syscall"
+	"time"
+)
+
+type epoll struct {
+	fd     int
+	events []syscall.EpollEvent
+}
+
+func newPoller(maxEvents int) (poller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &epoll{
+		fd:     fd,
+		events: make([]syscall.EpollEvent, maxEvents),
+	}, nil
+}
+
+func (p *epoll) Add(fd int) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{
+		Events: syscall.EPOLLIN,
+		Fd:     int32(fd),
+	})
+}
+
+func (p *epoll) Remove(fd int) error {
+	// a non nil event is required for kernels older than 2.6.9
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, fd, &syscall.EpollEvent{})
+}
+
+func (p *epoll) Wait(fds []int, timeout time.Duration) (int, error) {
+	events := p.events
+	if len(fds) < len(events) {
+		events = events[:len(fds)]
+	}
+
+	n, err := syscall.EpollWait(p.fd, events, int(timeout.Milliseconds()))
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		fds[i] = int(events[i].Fd)
+	}
+	return n, nil
+}
+
+func (p *epoll) Close() error {
+	return syscall.Close(p.fd)
+}
@@ -0,0 +1,63 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package server
+
+import (
+	"syscall"
+	"time"
+)
+
+type kqueue struct {
+	fd     int
+	events []syscall.Kevent_t
+}
+
+func newPoller(maxEvents int) (poller, error) {
+	fd, err := syscall.Kqueue()
+	if err != nil {
+		return nil, err
+	}
+	return &kqueue{
+		fd:     fd,
+		events: make([]syscall.Kevent_t, maxEvents),
+	}, nil
+}
+
+func (p *kqueue) change(fd int, flags int) error {
+	var ev syscall.Kevent_t
+	syscall.SetKevent(&ev, fd, syscall.EVFILT_READ, flags)
+
+	if changeEventRegistered, err := syscall.Kevent(p.fd, []syscall.Kevent_t{ev}, nil, nil); err != nil || changeEventRegistered == -1 {
+		return err
+	}
+	return nil
+}
+
+func (p *kqueue) Add(fd int) error {
+	return p.change(fd, syscall.EV_ADD|syscall.EV_ENABLE)
+}
+
+func (p *kqueue) Remove(fd int) error {
+	return p.change(fd, syscall.EV_DELETE)
+}
+
+func (p *kqueue) Wait(fds []int, timeout time.Duration) (int, error) {
+	events := p.events
+	if len(fds) < len(events) {
+		events = events[:len(fds)]
+	}
+
+	ts := syscall.NsecToTimespec(timeout.Nanoseconds())
+	n, err := syscall.Kevent(p.fd, nil, events, &ts)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		fds[i] = int(events[i].Ident)
+	}
+	return n, nil
+}
+
+func (p *kqueue) Close() error {
+	return syscall.Close(p.fd)
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/savannahar68/echo-server/core"
+)
+
+const defaultMaxClients = 20000
+
+// Options configures a Server
+type Options struct {
+	// Network is "tcp", the default, or "unix"
+	Network string
+	// Addr is the host:port to listen on for tcp, port 0 picks a free
+	// port, and the path of the socket for unix
+	Addr string
+	// Store is served to the clients, its dataset must already be loaded.
+	// When nil the server serves an empty store without persistence.
+	Store *core.Store
+	// MaxClients is the number of connections the event loop handles at
+	// once, 20000 when 0
+	MaxClients int
+}
+
+// Server is an instance of the event loop serving a store, several
+// servers run independently in the same process
+type Server struct {
+	opts  Options
+	store *core.Store
+
+	status int32
+	addr   net.Addr
+	fd     int
+	p      poller
+
+	// clients are the connected clients by fd, only the event loop
+	// goroutine accesses them
+	clients  map[int]*core.Client
+	lastCron time.Time
+
+	// the event loop watches the read end of the wake pipe, a byte is
+	// written to it to interrupt a Wait when the server is shut down
+	mu      sync.Mutex
+	started bool
+	closed  bool
+	wakeR   int
+	wakeW   int
+	done    chan struct{}
+}
+
+// New returns a server for opts, Start makes it listen
+func New(opts Options) (*Server, error) {
+	switch opts.Network {
+	case "":
+		opts.Network = "tcp"
+	case "tcp", "unix":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", opts.Network)
+	}
+	if opts.Network == "unix" && opts.Addr == "" {
+		return nil, errors.New("the path of the unix socket is missing")
+	}
+	if opts.MaxClients == 0 {
+		opts.MaxClients = defaultMaxClients
+	}
+
+	store := opts.Store
+	if store == nil {
+		cfg := core.DefaultConfig()
+		cfg.AppendOnly = false
+		cfg.Save = ""
+		var err error
+		if store, err = core.NewStore(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Server{
+		opts:    opts,
+		store:   store,
+		status:  EngineStatus_WAITING,
+		fd:      -1,
+		clients: make(map[int]*core.Client),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Start binds the listening socket and serves the clients from a
+// background goroutine until Shutdown is called or ctx is done
+func (s *Server) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return errors.New("server already started")
+	}
+
+	fd, addr, err := listen(s.opts.Network, s.opts.Addr, s.opts.MaxClients)
+	if err != nil {
+		return err
+	}
+
+	// create the poller, epoll on linux and kqueue on darwin/bsd
+	p, err := newPoller(s.opts.MaxClients)
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	var pipe [2]int
+	if err := syscall.Pipe(pipe[:]); err != nil {
+		p.Close()
+		syscall.Close(fd)
+		return err
+	}
+	syscall.SetNonblock(pipe[0], true)
+	syscall.SetNonblock(pipe[1], true)
+
+	// Listen to read events on the server itself and on the wake pipe
+	for _, watched := range []int{fd, pipe[0]} {
+		if err := p.Add(watched); err != nil {
+			p.Close()
+			syscall.Close(fd)
+			syscall.Close(pipe[0])
+			syscall.Close(pipe[1])
+			return err
+		}
+	}
+
+	s.fd, s.addr, s.p = fd, addr, p
+	s.wakeR, s.wakeW = pipe[0], pipe[1]
+	s.lastCron = time.Now()
+	s.started = true
+
+	log.Println("Starting an asynchronous server on", addr)
+	go s.eventLoop()
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.stop()
+		case <-s.done:
+		}
+	}()
+	return nil
+}
+
+// Addr is the address the server listens on, nil until it is started
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
+
+// Store is the store served by the server
+func (s *Server) Store() *core.Store {
+	return s.store
+}
+
+// Shutdown stops accepting commands once the one being executed is
+// done, disconnects the clients and shuts the store down. It returns
+// ctx.Err() when ctx is done first, the shutdown then completes in the
+// background.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	started := s.started
+	s.mu.Unlock()
+	if !started {
+		s.store.Shutdown()
+		return nil
+	}
+
+	s.stop()
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stop asks the event loop to exit
+func (s *Server) stop() {
+	atomic.StoreInt32(&s.status, EngineStatus_SHUTTING_DOWN)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		syscall.Write(s.wakeW, []byte{0})
+	}
+}
+
+// listen creates a non-blocking socket listening on addr
+func listen(network, addr string, backlog int) (int, net.Addr, error) {
+	var sa syscall.Sockaddr
+	domain := syscall.AF_UNIX
+
+	if network == "tcp" {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return -1, nil, err
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return -1, nil, fmt.Errorf("invalid port %q", portStr)
+		}
+		ip := net.IPv4zero
+		if host != "" {
+			ips, err := net.LookupIP(host)
+			if err != nil {
+				return -1, nil, err
+			}
+			ip = ips[0]
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			sa4 := &syscall.SockaddrInet4{Port: port}
+			copy(sa4.Addr[:], ip4)
+			sa, domain = sa4, syscall.AF_INET
+		} else {
+			sa6 := &syscall.SockaddrInet6{Port: port}
+			copy(sa6.Addr[:], ip.To16())
+			sa, domain = sa6, syscall.AF_INET6
+		}
+	} else {
+		// a socket left behind by a previous run would fail the bind
+		syscall.Unlink(addr)
+		sa = &syscall.SockaddrUnix{Name: addr}
+	}
+
+	fd, err := syscall.Socket(domain, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return -1, nil, err
+	}
+	if domain != syscall.AF_UNIX {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			syscall.Close(fd)
+			return -1, nil, err
+		}
+	}
+
+	// set the server socket as non-blocking
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return -1, nil, err
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return -1, nil, err
+	}
+	if err := syscall.Listen(fd, backlog); err != nil {
+		syscall.Close(fd)
+		return -1, nil, err
+	}
+
+	// the kernel picks the port when it is 0
+	bound, err := syscall.Getsockname(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return -1, nil, err
+	}
+	switch sa := bound.(type) {
+	case *syscall.SockaddrInet4:
+		return fd, &net.TCPAddr{IP: net.IP(sa.Addr[:]).To16(), Port: sa.Port}, nil
+	case *syscall.SockaddrInet6:
+		return fd, &net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port}, nil
+	}
+	return fd, &net.UnixAddr{Name: addr, Net: "unix"}, nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startServer starts a server for opts and shuts it down with the test
+func startServer(t *testing.T, opts Options) *Server {
+	srv, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return srv
+}
+
+// send writes the command to conn and returns the first line of its reply
+func send(t *testing.T, conn net.Conn, r *bufio.Reader, args ...string) string {
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		t.Fatal(err)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+func TestIsolatedServers(t *testing.T) {
+	t.Parallel()
+	servers := []*Server{
+		startServer(t, Options{Addr: "127.0.0.1:0"}),
+		startServer(t, Options{Addr: "127.0.0.1:0"}),
+		startServer(t, Options{Network: "unix", Addr: filepath.Join(t.TempDir(), "dice.sock")}),
+	}
+
+	for i, srv := range servers {
+		addr := srv.Addr()
+		conn, err := net.Dial(addr.Network(), addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		if reply := send(t, conn, r, "PING"); reply != "+PONG" {
+			t.Fatalf("%s: unexpected reply %q", addr, reply)
+		}
+		if reply := send(t, conn, r, "DBSIZE"); reply != ":0" {
+			t.Fatalf("%s: the keys of another server are visible: %q", addr, reply)
+		}
+		if reply := send(t, conn, r, "SET", "k", fmt.Sprint(i)); reply != "+OK" {
+			t.Fatalf("%s: unexpected reply %q", addr, reply)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+	srv, err := New(Options{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Addr() != nil {
+		t.Fatalf("a server has an address before it is started")
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	addr := srv.Addr().(*net.TCPAddr)
+	if addr.Port == 0 {
+		t.Fatalf("the server did not pick a port")
+	}
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if reply := send(t, conn, r, "PING"); reply != "+PONG" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Fatalf("the client is still connected after the shutdown")
+	}
+	if conn, err := net.Dial("tcp", addr.String()); err == nil {
+		conn.Close()
+		t.Fatalf("the server still accepts connections after the shutdown")
+	}
+}
@@ -28,37 +28,44 @@ func readCommand(c io.ReadWriter) (*core.RedisCmd, error) {
 	}, nil
 }
 
-func readCommands(c io.ReadWriter) (core.RedisCmds, error) {
-	var buf []byte = make([]byte, 512)
-	n, err := c.Read(buf[:])
-	if err != nil {
-		return nil, err
-	}
-	values, err := core.Decode(buf[:n])
-
-	if err != nil {
+// readCommands returns the commands fully received from c. When the
+// client sent a malformed frame the commands preceding it are returned
+// along with a *core.ProtocolError.
+func readCommands(c *core.Client) (core.RedisCmds, error) {
+	if err := c.ReadQuery(); err != nil {
 		return nil, err
 	}
+	values, err := c.DecodeQuery()
 
 	var cmds = make([]*core.RedisCmd, 0)
 
 	for _, value := range values {
-		tokens, err := toArrayString(value.([]interface{}))
+		tokens, err := toArrayString(value)
 		if err != nil {
-			return nil, err
+			return cmds, err
+		}
+		// an empty array is a no-op
+		if len(tokens) == 0 {
+			continue
 		}
 		cmds = append(cmds, &core.RedisCmd{
 			Cmd:  tokens[0],
 			Args: tokens[1:],
 		})
 	}
-	return cmds, nil
+	return cmds, err
 }
 
-func toArrayString(value []interface{}) ([]string, error) {
-	as := make([]string, len(value))
+func toArrayString(value interface{}) ([]string, error) {
+	elems, ok := value.([]interface{})
+	if !ok {
+		return nil, &core.ProtocolError{Reason: "expected an array of bulk strings"}
+	}
+	as := make([]string, len(elems))
 	for i := range as {
-		as[i] = value[i].(string)
+		if as[i], ok = elems[i].(string); !ok {
+			return nil, &core.ProtocolError{Reason: "expected an array of bulk strings"}
+		}
 	}
 	return as, nil
 }
@@ -107,7 +114,7 @@ func respond(cmds core.RedisCmds, c *core.Client) {
 //				log.Println("err", err)
 //			}
 //			log.Println("command", cmd)
-//			respond(core.RedisCmds{cmd}, *core.NewClient(0)) // TODO: to run async server made this as default 0 fd
+//			respond(core.RedisCmds{cmd}, store.NewClient(0)) // TODO: to run async server made this as default 0 fd
 //		}
 //	}
 //}